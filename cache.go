@@ -22,17 +22,23 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
-	"path"
-	"path/filepath"
 	"sync"
 	"time"
-
-	"github.com/pkg/errors"
 )
 
+// cacheStateDir is a directory inside the cache root where the internal state
+// is kept, requests for /_viadown/ are never forwarded upstream, thus it will
+// not conflict with any cached entry
+const cacheStateDir = "_viadown"
+
 type ReadSeekCloser interface {
 	io.ReadSeeker
 	io.Closer
@@ -46,9 +52,25 @@ type PurgeEvent struct {
 const PurgeHistoryMaxCount = 5
 
 type CacheStats struct {
-	Hit          int
-	Miss         int
-	PurgeHistory []PurgeEvent
+	Hit  int
+	Miss int
+	// HotHit and HotMiss count the hits served from the memory tier and
+	// from the storage, when the memory tier is enabled
+	HotHit  int
+	HotMiss int
+	// Corrupt is the number of entries found to be corrupt
+	Corrupt int
+	// LengthMismatch is the number of downloads where the size of data
+	// differed from the length announced by upstream
+	LengthMismatch int
+	// TemporaryRemoved and TemporaryRemovedSize are the number and size of
+	// temporary files left behind by an earlier run, removed at startup
+	TemporaryRemoved     int
+	TemporaryRemovedSize int64
+	PurgeHistory         []PurgeEvent
+	// Roots is the use of storage roots, when the cache is spread across
+	// several of them
+	Roots []RootStats `json:",omitempty"`
 }
 
 type CacheCount struct {
@@ -59,71 +81,253 @@ type CacheCount struct {
 }
 
 type Cache struct {
-	Dir       string
-	dirLock   sync.Mutex
+	Dir string
+	// Storage keeps the entries and the internal state, the files in Dir
+	// are used if not set
+	Storage Storage
+	// MaxOrphans is the maximum number of downloads that keep running
+	// after all their readers are gone, 0 means no limit
+	MaxOrphans int
+	// OrphanTimeout is the time after which an orphaned download is
+	// aborted, 0 means no timeout
+	OrphanTimeout time.Duration
+	// MaxSize is the limit of the total size of entries, the least
+	// recently used entries are evicted when the cache grows over it, 0
+	// means no limit
+	MaxSize int64
+	// HotMaxSize is the limit of the total size of entries kept in
+	// memory, 0 disables the memory tier
+	HotMaxSize int64
+	// HotMaxEntrySize is the size of the largest entry kept in memory, 0
+	// means no limit other than HotMaxSize
+	HotMaxEntrySize int64
+	// HotMinHits is the number of hits of an entry before it is kept in
+	// memory, so that the entries used once do not push out the frequently
+	// used ones
+	HotMinHits int
+	// VerifyHits is the share of hits, between 0 and 1, for which the data
+	// is verified against its digest before being served
+	VerifyHits float64
+	// PartialMaxAge is the time after which the partial data of a download
+	// that was not resumed is removed when purging, 0 means that it is
+	// kept until resumed
+	PartialMaxAge time.Duration
+
+	// the locks of the entries that are locked or waited for
+	entryLocks     map[string]*entryLock
+	entryLocksLock sync.Mutex
+
 	stats     CacheStats
 	statsLock sync.Mutex
+
+	downloads     map[string]*Download
+	orphans       int
+	downloadsLock sync.Mutex
+
+	hot hotTier
+
+	// serializes sharing of blobs with their removal
+	blobLock sync.Mutex
+
+	index         cacheIndex
+	indexLock     sync.Mutex
+	indexSaveLock sync.Mutex
+}
+
+// entryLock is the lock of an entry, held for reading while the entry is
+// opened, and for writing while it is being replaced or removed. The lock is
+// dropped once no longer used by anyone.
+type entryLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func (c *Cache) acquireEntryLock(key string) *entryLock {
+	c.entryLocksLock.Lock()
+	defer c.entryLocksLock.Unlock()
+
+	if c.entryLocks == nil {
+		c.entryLocks = make(map[string]*entryLock)
+	}
+	l := c.entryLocks[key]
+	if l == nil {
+		l = &entryLock{}
+		c.entryLocks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func (c *Cache) releaseEntryLock(key string, l *entryLock) {
+	c.entryLocksLock.Lock()
+	defer c.entryLocksLock.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(c.entryLocks, key)
+	}
 }
 
-func (c *Cache) getCachePath(name string) string {
-	cpath := path.Join(c.Dir, name)
-	log.Debugf("cache path: %v", cpath)
-	return cpath
+// lockEntry locks an entry for writing, returns the function unlocking it
+func (c *Cache) lockEntry(name string) (unlock func()) {
+	key := indexKey(name)
+	l := c.acquireEntryLock(key)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		c.releaseEntryLock(key, l)
+	}
+}
+
+// rlockEntry locks an entry for reading, returns the function unlocking it
+func (c *Cache) rlockEntry(name string) (unlock func()) {
+	key := indexKey(name)
+	l := c.acquireEntryLock(key)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		c.releaseEntryLock(key, l)
+	}
+}
+
+// storage returns the storage of the entries, the files in Dir are used
+// unless Storage is set
+func (c *Cache) storage() Storage {
+	if c.Storage != nil {
+		return c.Storage
+	}
+	return &FileStorage{Dir: c.Dir}
 }
 
 func (c *Cache) Get(name string) (ReadSeekCloser, int64, error) {
-	c.dirLock.Lock()
-	defer c.dirLock.Unlock()
+	r, size, err := c.get(name)
+	if _, ok := err.(*errCorrupt); ok {
+		if _, err := c.quarantine(name); err != nil {
+			log.Errorf("cannot quarantine %v: %v", name, err)
+		}
+		// the entry is obtained again
+		return nil, 0, notExistError("open", name)
+	}
+	return r, size, err
+}
+
+// errCorrupt is returned for an entry that failed verification
+type errCorrupt struct {
+	name    string
+	problem string
+}
+
+func (e *errCorrupt) Error() string {
+	return fmt.Sprintf("cache entry %v is corrupt: %v", e.name, e.problem)
+}
+
+func (c *Cache) get(name string) (ReadSeekCloser, int64, error) {
+	unlock := c.rlockEntry(name)
+	defer unlock()
+
+	if e := c.hot.get(name); e != nil {
+		c.hit()
+		c.hotHit(true)
+		c.used(name, int64(len(e.data)), e.modTime)
+		return hotReader{bytes.NewReader(e.data)}, int64(len(e.data)), nil
+	}
+	hotSeq := c.hot.sequence()
+
+	// the entry is not evicted while it is being read
+	c.acquire(name)
 
-	f, err := os.Open(c.getCachePath(name))
+	r, info, err := c.storage().Get(name)
 	if err != nil {
+		c.release(name)
 		if os.IsNotExist(err) {
 			c.miss()
+			// the entry may have been removed behind our back
+			c.removed(name)
 		}
 		log.Errorf("cache get error: %v", err)
 		return nil, 0, err
 	}
 
-	c.hit()
+	if c.VerifyHits > 0 && rand.Float64() < c.VerifyHits {
+		if err := c.verify(name, r, info.Size); err != nil {
+			r.Close()
+			c.release(name)
+			c.miss()
+			log.Errorf("cache get error: %v", err)
+			return nil, 0, err
+		}
+	}
 
-	fi, err := f.Stat()
-	if err != nil {
-		log.Errorf("file %s stat failed: %v", f.Name(), err)
-		f.Close()
-		return nil, 0, err
+	c.hit()
+	hits := c.used(name, info.Size, info.ModTime)
+
+	if c.HotMaxSize > 0 {
+		c.hotHit(false)
+		if hits >= c.HotMinHits && c.fitsHot(info.Size) {
+			data, err := ioutil.ReadAll(r)
+			r.Close()
+			c.release(name)
+			if err != nil {
+				log.Errorf("cannot read %v: %v", name, err)
+				return nil, 0, err
+			}
+			c.hot.put(name, data, info.ModTime, hotSeq, c.HotMaxSize)
+			return hotReader{bytes.NewReader(data)}, int64(len(data)), nil
+		}
 	}
 
-	return f, fi.Size(), nil
+	return &cacheReader{
+		StorageReader: r,
+		release:       func() { c.release(name) },
+	}, info.Size, nil
 }
 
 func (c *Cache) Put(name string) (*CacheTemporaryObject, error) {
-	c.dirLock.Lock()
-	defer c.dirLock.Unlock()
-
-	cpath := c.getCachePath(name)
-
-	if err := os.MkdirAll(path.Dir(cpath), 0700); err != nil {
-		return nil, err
-	}
-
-	f, err := ioutil.TempFile(path.Dir(cpath), path.Base(cpath)+".part.")
+	w, err := c.storage().Put(name)
 	if err != nil {
-		log.Errorf("cache put for %v error: %v", cpath, err)
+		log.Errorf("cache put for %v error: %v", name, err)
 		return nil, err
 	}
 
 	ct := CacheTemporaryObject{
-		File:       f,
-		targetName: cpath,
-		curName:    f.Name(),
+		w:        w,
+		cache:    c,
+		name:     name,
+		metaName: c.getMetaName(name),
+		hash:     sha256.New(),
 	}
 	return &ct, nil
 }
 
+// RemoveTemporary removes the temporary data left behind when the process was
+// killed while writing to the cache, it must be called before the cache is in
+// use
+func (c *Cache) RemoveTemporary() error {
+	r, ok := c.storage().(TemporaryRemover)
+	if !ok {
+		return nil
+	}
+	count, size, err := r.RemoveTemporary()
+	if count > 0 {
+		log.Infof("removed %v orphaned temporary files, %v bytes", count, size)
+	}
+
+	c.statsLock.Lock()
+	c.stats.TemporaryRemoved += count
+	c.stats.TemporaryRemovedSize += size
+	c.statsLock.Unlock()
+	return err
+}
+
 func (c *Cache) Stats() CacheStats {
 	c.statsLock.Lock()
-	defer c.statsLock.Unlock()
-	return c.stats
+	stats := c.stats
+	c.statsLock.Unlock()
+
+	if m, ok := c.storage().(*MultiStorage); ok {
+		stats.Roots = m.RootStats()
+	}
+	return stats
 }
 
 func (c *Cache) hit() {
@@ -138,34 +342,100 @@ func (c *Cache) miss() {
 	c.stats.Miss++
 }
 
-func (c *Cache) Count() (CacheCount, error) {
-	c.dirLock.Lock()
-	defer c.dirLock.Unlock()
+func (c *Cache) lengthMismatch() {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	c.stats.LengthMismatch++
+}
 
-	count := CacheCount{}
-	walkCount := func(name string, fi os.FileInfo, err error) error {
-		if err != nil {
-			return errors.Wrapf(err, "cannot process path %v", name)
-		}
-		if fi.IsDir() {
-			return nil
+func (c *Cache) corrupt() {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	c.stats.Corrupt++
+}
+
+// verify checks the data of an entry being read, the reader is rewound
+func (c *Cache) verify(name string, r StorageReader, size int64) error {
+	meta, err := c.GetMeta(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("cannot verify %v: %v", name, err)
 		}
-		count.Items++
-		count.TotalSize += uint64(fi.Size())
 		return nil
 	}
-	err := filepath.Walk(c.Dir, walkCount)
-	return count, err
+	problem, _ := verifyData(r, size, meta)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if problem != "" {
+		return &errCorrupt{name: name, problem: problem}
+	}
+	return nil
+}
+
+func (c *Cache) hotHit(hit bool) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	if hit {
+		c.stats.HotHit++
+	} else {
+		c.stats.HotMiss++
+	}
+}
+
+// fitsHot returns true if an entry of given size can be kept in memory
+func (c *Cache) fitsHot(size int64) bool {
+	if c.HotMaxEntrySize > 0 && size > c.HotMaxEntrySize {
+		return false
+	}
+	return size <= c.HotMaxSize
+}
+
+func (c *Cache) Count() (CacheCount, error) {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if err := c.loadIndexLocked(); err != nil {
+		return CacheCount{}, err
+	}
+	return CacheCount{
+		Items:     uint64(len(c.index.entries)),
+		TotalSize: uint64(c.index.total),
+	}, nil
 }
 
+// PurgeSelector selects the entries to remove, all of the non-zero criteria
+// must be met
 type PurgeSelector struct {
+	// OlderThan selects the entries obtained earlier than given time ago
 	OlderThan time.Duration
+	// NotAccessedFor selects the entries that were not accessed for given
+	// time
+	NotAccessedFor time.Duration
+	// MinHits selects the entries that were hit fewer times than given
+	MinHits int
+}
+
+func (p *PurgeSelector) selects(ie *indexEntry, now time.Time) bool {
+	if p.OlderThan != 0 && now.Sub(ie.modTime) < p.OlderThan {
+		return false
+	}
+	if p.NotAccessedFor != 0 && now.Sub(ie.lastUsed) < p.NotAccessedFor {
+		return false
+	}
+	if p.MinHits != 0 && ie.hits >= p.MinHits {
+		return false
+	}
+	return true
 }
 
 func (c *Cache) addPurgeEvent(event PurgeEvent) {
 	if event.When.IsZero() {
 		return
 	}
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
 	history := c.stats.PurgeHistory
 	if len(history) >= PurgeHistoryMaxCount {
 		history = history[1:]
@@ -174,49 +444,66 @@ func (c *Cache) addPurgeEvent(event PurgeEvent) {
 }
 
 func (c *Cache) Purge(what PurgeSelector) (removed uint64, err error) {
-	c.dirLock.Lock()
-	defer c.dirLock.Unlock()
-
 	now := time.Now()
 
-	log.Infof("cache purge: older than %v", what.OlderThan)
+	log.Infof("cache purge: older than %v, not accessed for %v, min hits %v",
+		what.OlderThan, what.NotAccessedFor, what.MinHits)
 
-	var rmError error
-	walkPurgeSelected := func(name string, fi os.FileInfo, err error) error {
-		if err != nil {
-			return errors.Wrapf(err, "cannot process path %v", name)
-		}
-		if fi.IsDir() {
-			return nil
-		}
-		remove := true
-		if what.OlderThan != 0 && now.Sub(fi.ModTime()) < what.OlderThan {
-			remove = false
-		}
-		if remove {
-			log.Infof("removing %v", name)
-			err := os.Remove(name)
-			if err != nil && rmError == nil {
-				rmError = errors.Wrapf(err, "cannot remove entry %v", name)
-			}
-			if err == nil {
-				removed++
-			}
-		}
-		return nil
+	selected, err := c.selectEntries(what, now)
+	if err != nil {
+		return 0, err
 	}
-	err = filepath.Walk(c.Dir, walkPurgeSelected)
-	if err == nil {
-		c.addPurgeEvent(PurgeEvent{When: now, Removed: removed})
+	// only the entry being removed is locked at a time
+	for _, name := range selected {
+		log.Infof("removing %v", name)
+		unlock := c.lockEntry(name)
+		err := c.removeEntryLocked(name)
+		unlock()
+		switch {
+		case err == nil:
+			removed++
+		case !os.IsNotExist(err):
+			log.Errorf("cannot remove entry %v: %v", name, err)
+		}
 	}
-	return removed, err
+	c.collectBlobs()
+	c.expirePartials(now)
+	c.addPurgeEvent(PurgeEvent{When: now, Removed: removed})
+	return removed, nil
 }
 
 type CacheTemporaryObject struct {
-	*os.File
-	targetName string
-	curName    string
-	aborted    bool
+	w       StorageWriter
+	cache   *Cache
+	name    string
+	aborted bool
+
+	// Meta is recorded when the object is committed, the size, digest and
+	// fetch time are filled automatically
+	Meta     EntryMeta
+	metaName string
+	hash     hash.Hash
+	size     int64
+
+	// set for objects that can be suspended
+	infoName string
+	info     PartialInfo
+}
+
+func (ct *CacheTemporaryObject) Write(data []byte) (int, error) {
+	n, err := ct.w.Write(data)
+	ct.hash.Write(data[:n])
+	ct.size += int64(n)
+	return n, err
+}
+
+func (ct *CacheTemporaryObject) WriteString(data string) (int, error) {
+	return ct.Write([]byte(data))
+}
+
+// open returns a reader of the data written so far
+func (ct *CacheTemporaryObject) open() (StorageReader, error) {
+	return ct.w.Open()
 }
 
 func (ct *CacheTemporaryObject) Commit() error {
@@ -224,29 +511,89 @@ func (ct *CacheTemporaryObject) Commit() error {
 		return nil
 	}
 
-	if err := ct.Close(); err != nil {
-		return err
+	ct.Meta.ContentLength = ct.size
+	ct.Meta.Digest = fmt.Sprintf("sha256:%x", ct.hash.Sum(nil))
+	if ct.Meta.Fetched.IsZero() {
+		ct.Meta.Fetched = time.Now()
 	}
 
-	if err := os.Rename(ct.curName, ct.targetName); err != nil {
-		log.Errorf("rename %v -> %v failed: %v",
-			ct.curName, ct.targetName, err)
+	// the data and metadata are synced or uploaded before the entry is
+	// locked, so that readers of the entry are not held up by it
+	if err := prepareWriter(ct.w); err != nil {
+		return err
+	}
+	mw, err := prepareMeta(ct.cache.storage(), ct.metaName, &ct.Meta)
+	if err != nil {
 		return err
 	}
-	log.Debugf("commited cache entry %v to %v", ct.curName, ct.targetName)
+	shared, err := ct.commitLocked(mw)
+	if err != nil {
+		return err
+	}
+	ct.cache.committed(ct.name, ct.size, shared)
 	return nil
 }
 
-func (ct *CacheTemporaryObject) Abort() error {
-	log.Debugf("discard entry %v", ct.curName)
-	ct.aborted = true
+// commitLocked puts the data and the metadata written by mw in place with the
+// entry locked, so that readers never see the data along with the metadata of
+// the replaced entry, returns the digest if the data is shared with other
+// entries
+func (ct *CacheTemporaryObject) commitLocked(mw StorageWriter) (string, error) {
+	c := ct.cache
+	unlock := c.lockEntry(ct.name)
+	defer unlock()
+
+	// the replaced entry may have shared its data
+	var replaced string
+	if meta, err := readMeta(c.storage(), ct.metaName); err == nil {
+		replaced = meta.Digest
+	}
 
-	if err := ct.Close(); err != nil {
-		return err
+	if err := ct.w.Commit(ct.name); err != nil {
+		mw.Abort()
+		return "", err
+	}
+	log.Debugf("commited cache entry %v", ct.name)
+	ct.removeInfo()
+	// once the metadata is in place, any kept earlier is stale
+	defer c.hot.invalidate(ct.name)
+
+	if err := mw.Commit(ct.metaName); err != nil {
+		log.Errorf("cannot write metadata of %v: %v", ct.name, err)
+		// the metadata of the replaced entry does not match the data
+		if err := c.removeMeta(ct.name); err != nil {
+			log.Errorf("cannot remove metadata of %v: %v", ct.name, err)
+		}
+		return "", err
+	}
+	// the size of data shared with other entries is counted once
+	shared := ""
+	if c.dedup(ct.name, ct.Meta.Digest, ct.size) {
+		shared = ct.Meta.Digest
+	}
+	if replaced != "" {
+		c.releaseBlob(replaced)
+	}
+	return shared, nil
+}
+
+func (ct *CacheTemporaryObject) removeInfo() {
+	if ct.infoName == "" {
+		return
+	}
+	err := ct.cache.storage().Delete(ct.infoName)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("cannot remove partial data info %v: %v", ct.infoName, err)
 	}
+}
+
+func (ct *CacheTemporaryObject) Abort() error {
+	log.Debugf("discard entry %v", ct.name)
+	ct.aborted = true
 
-	if err := os.Remove(ct.curName); err != nil {
+	if err := ct.w.Abort(); err != nil {
 		return err
 	}
+	ct.removeInfo()
 	return nil
 }
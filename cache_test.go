@@ -22,10 +22,12 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -140,6 +142,190 @@ func TestCacheCommit(t *testing.T) {
 	assert.Equal(t, r, []byte("hello\n"))
 }
 
+// pausingStorage holds the commits of entry data, once the data is in place,
+// or the preparation of entry data to be committed, until released
+type pausingStorage struct {
+	*MemoryStorage
+	committed chan struct{}
+	prepared  chan struct{}
+	release   chan struct{}
+}
+
+func (s *pausingStorage) Put(name string) (StorageWriter, error) {
+	w, err := s.MemoryStorage.Put(name)
+	if err != nil {
+		return nil, err
+	}
+	return &pausingWriter{
+		StorageWriter: w,
+		s:             s,
+		isState:       strings.HasPrefix(name, cacheStateDir+"/"),
+	}, nil
+}
+
+func (s *pausingStorage) Append(name string, offset int64) (StorageWriter, error) {
+	w, err := s.MemoryStorage.Append(name, offset)
+	if err != nil {
+		return nil, err
+	}
+	// appended objects hold the data of entries being downloaded
+	return &pausingWriter{StorageWriter: w, s: s}, nil
+}
+
+type pausingWriter struct {
+	StorageWriter
+	s       *pausingStorage
+	isState bool
+}
+
+func (w *pausingWriter) Prepare() error {
+	if w.s.prepared != nil && !w.isState {
+		close(w.s.prepared)
+		<-w.s.release
+	}
+	return nil
+}
+
+func (w *pausingWriter) Commit(name string) error {
+	err := w.StorageWriter.Commit(name)
+	if w.s.committed != nil && !strings.HasPrefix(name, cacheStateDir+"/") {
+		close(w.s.committed)
+		<-w.s.release
+	}
+	return err
+}
+
+func TestCacheCommitReplaceConsistent(t *testing.T) {
+	s := &pausingStorage{MemoryStorage: &MemoryStorage{}}
+	c := Cache{Storage: s, VerifyHits: 1, HotMaxSize: 1024}
+
+	putEntry(t, &c, "foo", "old data")
+	r, _, err := c.Get("foo")
+	require.NoError(t, err)
+	assert.Equal(t, "old data", readAll(t, r))
+	r.Close()
+
+	s.committed, s.release = make(chan struct{}), make(chan struct{})
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		putEntry(t, &c, "foo", "new data")
+	}()
+	<-s.committed
+
+	// the new data is in place, but not its metadata yet
+	type result struct {
+		data string
+		meta *EntryMeta
+	}
+	got := make(chan result)
+	go func() {
+		r, _, err := c.Get("foo")
+		if !assert.NoError(t, err) {
+			close(got)
+			return
+		}
+		data := readAll(t, r)
+		r.Close()
+		meta, err := c.GetMeta("foo")
+		assert.NoError(t, err)
+		got <- result{data: data, meta: meta}
+	}()
+	select {
+	case <-got:
+		t.Fatalf("entry read while being committed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(s.release)
+	<-committed
+	res := <-got
+	assert.Equal(t, "new data", res.data)
+	require.NotNil(t, res.meta)
+	assert.Equal(t, digestOf("new data"), res.meta.Digest)
+	// the fresh entry was verified against its own digest
+	assert.Equal(t, 0, c.Stats().Corrupt)
+}
+
+func TestCacheCommitPrepareUnlocked(t *testing.T) {
+	s := &pausingStorage{MemoryStorage: &MemoryStorage{}}
+	c := Cache{Storage: s}
+
+	putEntry(t, &c, "foo", "old data")
+
+	s.prepared, s.release = make(chan struct{}), make(chan struct{})
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		putEntry(t, &c, "foo", "new data")
+	}()
+	<-s.prepared
+
+	// the entry is not locked while the new data is being prepared
+	got := make(chan string)
+	go func() {
+		defer close(got)
+		r, _, err := c.Get("foo")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer r.Close()
+		got <- readAll(t, r)
+	}()
+	select {
+	case data := <-got:
+		assert.Equal(t, "old data", data)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("entry not read while being prepared")
+	}
+
+	close(s.release)
+	<-committed
+	r, _, err := c.Get("foo")
+	require.NoError(t, err)
+	assert.Equal(t, "new data", readAll(t, r))
+	r.Close()
+}
+
+func TestCacheEntryLocks(t *testing.T) {
+	c := Cache{Storage: &MemoryStorage{}}
+
+	unlock := c.lockEntry("foo")
+	// the locks of other entries are not shared
+	others := make(chan struct{})
+	go func() {
+		defer close(others)
+		for i := 0; i < 1000; i++ {
+			unlock := c.lockEntry(fmt.Sprintf("bar-%v", i))
+			defer unlock()
+		}
+	}()
+	select {
+	case <-others:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("other entries not locked")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		defer close(locked)
+		unlock := c.rlockEntry("/foo")
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("entry locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	// the locks are dropped once released
+	c.entryLocksLock.Lock()
+	assert.Empty(t, c.entryLocks)
+	c.entryLocksLock.Unlock()
+}
+
 func TestCacheAbort(t *testing.T) {
 	td, err := ioutil.TempDir("", "viadown-cache-test-")
 	assert.NoError(t, err)
@@ -199,6 +385,9 @@ func TestCacheStats(t *testing.T) {
 	assert.NoError(t, err)
 	err = os.Chtimes(filepath.Join(td, "too-old"), now, now.Add(-olderThan).Add(-time.Hour))
 	assert.NoError(t, err)
+	// pick up the new file
+	err = c.Reindex()
+	assert.NoError(t, err)
 	removed, err := c.Purge(PurgeSelector{OlderThan: olderThan})
 	assert.Nil(t, err)
 	assert.Equal(t, uint64(1), removed)
@@ -310,8 +499,137 @@ func TestCacheCount(t *testing.T) {
 
 	err = os.Remove(filepath.Join(td, "bar"))
 	assert.NoError(t, err)
+	// the change is picked up once the index is updated
+	err = c.Reindex()
+	assert.NoError(t, err)
 
 	count, err = c.Count()
 	assert.NoError(t, err)
 	assert.Equal(t, CacheCount{Items: 1, TotalSize: 3}, count)
 }
+
+func TestCacheRemoveTemporary(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-cache-temp-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	makeFile(t, filepath.Join(td, "foo"), []byte("foo"))
+	// left behind when killed while writing
+	makeFile(t, filepath.Join(td, "foo.part.1234"), []byte("fo"))
+	makeFile(t, filepath.Join(td, "bar/baz.part.5678"), []byte("baz"))
+	makeFile(t, filepath.Join(td, "bar/qux.part.tar"), []byte("qux"))
+	// and so are the ones of the state
+	makeFile(t, filepath.Join(td, c.getIndexName()+".part.1234"), []byte("{"))
+	makeFile(t, filepath.Join(td, c.getMetaName("foo")+".part.1234"), []byte("{}"))
+	_, infoName := c.getPartialNames("partial")
+	makeFile(t, filepath.Join(td, infoName+".part.1234"), []byte("{}"))
+	// partial data of downloads is kept
+	ct, err := c.PutPartial("partial", PartialInfo{ETag: `"1234"`}, 0)
+	require.NoError(t, err)
+	_, err = ct.WriteString("12")
+	require.NoError(t, err)
+	require.NoError(t, ct.Suspend())
+
+	// temporary files are not entries
+	count, err := c.Count()
+	require.NoError(t, err)
+	assert.Equal(t, CacheCount{Items: 2, TotalSize: 6}, count)
+
+	require.NoError(t, c.RemoveTemporary())
+	notExist(t, filepath.Join(td, "foo.part.1234"))
+	notExist(t, filepath.Join(td, "bar/baz.part.5678"))
+	notExist(t, filepath.Join(td, c.getIndexName()+".part.1234"))
+	notExist(t, filepath.Join(td, c.getMetaName("foo")+".part.1234"))
+	notExist(t, filepath.Join(td, infoName+".part.1234"))
+	for _, name := range []string{"foo", "bar/qux.part.tar", infoName} {
+		_, err = os.Stat(filepath.Join(td, name))
+		assert.NoError(t, err)
+	}
+	pi, err := c.GetPartial("partial")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), pi.Size)
+
+	stats := c.Stats()
+	assert.Equal(t, 5, stats.TemporaryRemoved)
+	assert.Equal(t, int64(10), stats.TemporaryRemovedSize)
+
+	// nothing left
+	require.NoError(t, c.RemoveTemporary())
+	assert.Equal(t, 5, c.Stats().TemporaryRemoved)
+}
+
+func benchmarkCacheGet(b *testing.B, purging bool) {
+	td, err := ioutil.TempDir("", "viadown-cache-bench-")
+	require.NoError(b, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	const entries = 100
+	for i := 0; i < entries; i++ {
+		name := fmt.Sprintf("entry-%v", i)
+		require.NoError(b, ioutil.WriteFile(filepath.Join(td, name), []byte("data"), 0644))
+		// entries that were hit are not selected by the purge below
+		rd, _, err := c.Get(name)
+		require.NoError(b, err)
+		rd.Close()
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	if purging {
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for i := 0; i < 10; i++ {
+					ct, err := c.Put(fmt.Sprintf("junk-%v", i))
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					ct.WriteString("junk")
+					ct.Commit()
+				}
+				if _, err := c.Purge(PurgeSelector{MinHits: 1}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	} else {
+		close(done)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			rd, _, err := c.Get(fmt.Sprintf("entry-%v", i%entries))
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			rd.Close()
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	<-done
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	benchmarkCacheGet(b, false)
+}
+
+// BenchmarkCacheGetPurging measures the throughput of reading entries while
+// the cache is being purged
+func BenchmarkCacheGetPurging(b *testing.B) {
+	benchmarkCacheGet(b, true)
+}
@@ -0,0 +1,164 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// blobsDir is a directory inside the state directory, where the data of
+// entries is kept under the names derived from its digest. Entries of the
+// same contents share the data of their blob, when supported by the storage.
+const blobsDir = "blobs"
+
+// getBlobName returns the name of the blob of data with given digest, in the
+// form of <algorithm>:<hex-digest>, or an empty string if the digest is not
+// valid
+func getBlobName(digest string) string {
+	i := strings.Index(digest, ":")
+	if i <= 0 {
+		return ""
+	}
+	algo, sum := digest[:i], digest[i+1:]
+	if len(sum) < 2 || strings.ContainsAny(digest, "/\\.") {
+		return ""
+	}
+	return path.Join(cacheStateDir, blobsDir, algo, sum[:2], sum)
+}
+
+// dedup makes the committed entry share the data with the entries of the same
+// digest, returns false if the data is not shared
+func (c *Cache) dedup(name, digest string, size int64) bool {
+	s := c.storage()
+	l, ok := s.(Linker)
+	blob := getBlobName(digest)
+	if !ok || blob == "" {
+		return false
+	}
+
+	c.blobLock.Lock()
+	defer c.blobLock.Unlock()
+
+	if info, err := s.Stat(blob); err == nil && info.Size == size {
+		err := l.Link(blob, name)
+		if err == nil {
+			log.Debugf("entry %v shares data of %v", name, digest)
+			return true
+		}
+		log.Errorf("cannot link %v to blob %v: %v", name, digest, err)
+	}
+	// the entry becomes the blob
+	if err := l.Link(name, blob); err != nil {
+		log.Errorf("cannot link blob %v to %v: %v", digest, name, err)
+		return false
+	}
+	return true
+}
+
+// releaseBlob removes the blob of given digest, unless some entry still
+// shares its data
+func (c *Cache) releaseBlob(digest string) {
+	s := c.storage()
+	blob := getBlobName(digest)
+	if _, ok := s.(Linker); !ok || blob == "" {
+		return
+	}
+
+	c.blobLock.Lock()
+	defer c.blobLock.Unlock()
+
+	c.releaseBlobLocked(s, blob)
+}
+
+// dropBlob removes the blob of given digest, regardless of the entries sharing
+// its data
+func (c *Cache) dropBlob(digest string) {
+	blob := getBlobName(digest)
+	if blob == "" {
+		return
+	}
+
+	c.blobLock.Lock()
+	defer c.blobLock.Unlock()
+
+	err := c.storage().Delete(blob)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("cannot remove blob %v: %v", blob, err)
+	}
+}
+
+func (c *Cache) releaseBlobLocked(s Storage, blob string) {
+	info, err := s.Stat(blob)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("cannot check blob %v: %v", blob, err)
+		}
+		return
+	}
+	// the number of links is not known, or there are other entries
+	if info.Links != 1 {
+		return
+	}
+	log.Debugf("removing unused blob %v", blob)
+	if err := s.Delete(blob); err != nil && !os.IsNotExist(err) {
+		log.Errorf("cannot remove blob %v: %v", blob, err)
+	}
+}
+
+// collectBlobs removes the blobs not shared with any entry, which may be left
+// behind if the process was interrupted
+func (c *Cache) collectBlobs() {
+	s := c.storage()
+	if _, ok := s.(Linker); !ok {
+		return
+	}
+	prefix := path.Join(cacheStateDir, blobsDir)
+	var blobs []string
+	err := s.Walk(func(name string, info StorageInfo) error {
+		if info.IsDir {
+			// only the directories leading to blobs are visited
+			if name == prefix || strings.HasPrefix(name, prefix+"/") ||
+				strings.HasPrefix(prefix, name+"/") {
+				return nil
+			}
+			return filepath.SkipDir
+		}
+		if strings.HasPrefix(name, prefix+"/") && info.Links == 1 {
+			blobs = append(blobs, name)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("cannot collect unused blobs: %v", err)
+		return
+	}
+
+	c.blobLock.Lock()
+	defer c.blobLock.Unlock()
+
+	for _, blob := range blobs {
+		c.releaseBlobLocked(s, blob)
+	}
+}
@@ -0,0 +1,217 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func digestOf(data string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+}
+
+func removeEntry(t *testing.T, c *Cache, name string) {
+	unlock := c.lockEntry(name)
+	defer unlock()
+	require.NoError(t, c.removeEntryLocked(name))
+}
+
+func assertCount(t *testing.T, c *Cache, items, size uint64) {
+	count, err := c.Count()
+	require.NoError(t, err)
+	assert.Equal(t, CacheCount{Items: items, TotalSize: size}, count)
+}
+
+func TestGetBlobName(t *testing.T) {
+	assert.Equal(t, "_viadown/blobs/sha256/ab/abcd", getBlobName("sha256:abcd"))
+	for _, digest := range []string{"", "abcd", ":abcd", "sha256:a", "sha256:../..", "sha256:ab/cd"} {
+		assert.Equal(t, "", getBlobName(digest), "digest %q", digest)
+	}
+}
+
+func TestCacheDedup(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-dedup-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	putEntry(t, &c, "foo", "1234")
+	putEntry(t, &c, "bar/baz", "1234")
+	putEntry(t, &c, "other", "5678")
+
+	// both entries share the data of the blob
+	blob := filepath.Join(td, getBlobName(digestOf("1234")))
+	fooInfo, err := os.Stat(filepath.Join(td, "foo"))
+	require.NoError(t, err)
+	for _, fpath := range []string{filepath.Join(td, "bar/baz"), blob} {
+		fi, err := os.Stat(fpath)
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(fooInfo, fi), "%v is not shared", fpath)
+	}
+	assertCount(t, &c, 3, 8)
+
+	// the shared data is counted once when the index is restored, or
+	// rebuilt from the contents of the directory
+	require.NoError(t, c.saveIndex())
+	assertCount(t, &Cache{Dir: td}, 3, 8)
+	require.NoError(t, os.Remove(filepath.Join(td, c.getIndexName())))
+	assertCount(t, &Cache{Dir: td}, 3, 8)
+
+	// the blob is kept as long as some entry refers to it
+	removeEntry(t, &c, "foo")
+	_, err = os.Stat(blob)
+	assert.NoError(t, err)
+	r, _, err := c.Get("bar/baz")
+	require.NoError(t, err)
+	assert.Equal(t, "1234", readAll(t, r))
+	r.Close()
+	assertCount(t, &c, 2, 8)
+
+	removeEntry(t, &c, "bar/baz")
+	_, err = os.Stat(blob)
+	assert.True(t, os.IsNotExist(err))
+	assertCount(t, &c, 1, 4)
+}
+
+// countBlobs returns the number of blobs on disk
+func countBlobs(t *testing.T, dir string) int {
+	count := 0
+	err := filepath.Walk(filepath.Join(dir, cacheStateDir, blobsDir), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			count++
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return count
+}
+
+func TestCacheDedupReplaceReleasesBlob(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-dedup-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	for _, data := range []string{"core 1", "core 2", "core 3"} {
+		putEntry(t, &c, "core.db", data)
+	}
+	// only the blob of the current data is kept
+	assert.Equal(t, 1, countBlobs(t, td))
+	_, err = os.Stat(filepath.Join(td, getBlobName(digestOf("core 3"))))
+	assert.NoError(t, err)
+	assertCount(t, &c, 1, 6)
+
+	// the blob shared with another entry is kept
+	putEntry(t, &c, "other.db", "core 3")
+	putEntry(t, &c, "core.db", "core 4")
+	assert.Equal(t, 2, countBlobs(t, td))
+	r, _, err := c.Get("other.db")
+	require.NoError(t, err)
+	assert.Equal(t, "core 3", readAll(t, r))
+	r.Close()
+
+	// same data again
+	putEntry(t, &c, "core.db", "core 4")
+	assert.Equal(t, 2, countBlobs(t, td))
+	assertCount(t, &c, 2, 12)
+}
+
+func TestCacheDedupReplace(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-dedup-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	putEntry(t, &c, "foo", "1234")
+	putEntry(t, &c, "bar", "1234")
+	assertCount(t, &c, 2, 4)
+
+	// the replaced entry no longer shares the data
+	putEntry(t, &c, "foo", "abcdef")
+	assertCount(t, &c, 2, 10)
+	r, _, err := c.Get("bar")
+	require.NoError(t, err)
+	assert.Equal(t, "1234", readAll(t, r))
+	r.Close()
+
+	// blobs left behind are removed when purging
+	makeFile(t, filepath.Join(td, getBlobName(digestOf("lost"))), []byte("lost"))
+	removed, err := c.Purge(PurgeSelector{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), removed)
+	var left []string
+	filepath.Walk(td, func(fpath string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			left = append(left, fpath)
+		}
+		return nil
+	})
+	// only the saved index may remain
+	for _, fpath := range left {
+		assert.Equal(t, filepath.Join(td, c.getIndexName()), fpath)
+	}
+}
+
+func TestCacheDedupMemoryStorage(t *testing.T) {
+	s := &MemoryStorage{}
+	c := Cache{Storage: s}
+
+	putEntry(t, &c, "foo", "1234")
+	putEntry(t, &c, "bar", "1234")
+	info, err := s.Stat(getBlobName(digestOf("1234")))
+	require.NoError(t, err)
+	assert.Equal(t, 3, info.Links)
+	assertCount(t, &c, 2, 4)
+
+	_, err = c.Purge(PurgeSelector{})
+	require.NoError(t, err)
+	assert.Empty(t, walkNames(t, s))
+}
+
+// plainStorage hides the ability of the storage to link objects
+type plainStorage struct {
+	Storage
+}
+
+func TestCacheNoDedup(t *testing.T) {
+	c := Cache{Storage: plainStorage{&MemoryStorage{}}}
+
+	putEntry(t, &c, "foo", "1234")
+	putEntry(t, &c, "bar", "1234")
+	assertCount(t, &c, 2, 8)
+	_, err := c.storage().Stat(getBlobName(digestOf("1234")))
+	assert.True(t, os.IsNotExist(err))
+}
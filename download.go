@@ -0,0 +1,488 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errDownloadNotStarted = errors.New("download finished without data")
+	errTooManyOrphans     = errors.New("too many orphaned downloads")
+	errOrphanTimeout      = errors.New("orphaned download timed out")
+	errShuttingDown       = errors.New("shutting down")
+)
+
+// Download is an upstream transfer of a single cache entry. The data is
+// written to a temporary cache object, while any number of readers can follow
+// it as it grows. The download is owned by the cache and continues when the
+// readers go away, in which case it becomes orphaned.
+type Download struct {
+	Name string
+
+	cache   *Cache
+	ctx     context.Context
+	cancel  context.CancelFunc
+	lock    sync.Mutex
+	cond    *sync.Cond
+	out     *CacheTemporaryObject
+	header  http.Header
+	written int64
+	readers int
+	// set while the data is being committed, suspended or discarded
+	finishing bool
+	done      bool
+	err       error
+	// closed once the download has ended
+	ended chan struct{}
+
+	// protected by the cache downloads lock
+	orphaned    bool
+	orphanTimer *time.Timer
+}
+
+// StartDownload returns a download of given cache entry that is already in
+// progress, or registers a new one. The caller which registered the download
+// (isNew is true) is responsible for finishing it.
+func (c *Cache) StartDownload(name string) (d *Download, isNew bool) {
+	c.downloadsLock.Lock()
+	defer c.downloadsLock.Unlock()
+
+	if d, ok := c.downloads[name]; ok {
+		return d, false
+	}
+	if c.downloads == nil {
+		c.downloads = make(map[string]*Download)
+	}
+	d = &Download{
+		Name:  name,
+		cache: c,
+		ended: make(chan struct{}),
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.cond = sync.NewCond(&d.lock)
+	c.downloads[name] = d
+	// the entry is not evicted while it is being written
+	c.acquire(name)
+	return d, true
+}
+
+func (c *Cache) endDownload(d *Download) {
+	c.downloadsLock.Lock()
+	defer c.downloadsLock.Unlock()
+
+	if c.downloads[d.Name] == d {
+		delete(c.downloads, d.Name)
+	}
+	c.unorphan(d)
+	c.release(d.Name)
+	d.cancel()
+	close(d.ended)
+}
+
+// Close waits for the downloads in progress to finish, until the context is
+// done, after which the remaining downloads are aborted. The data of aborted
+// downloads is kept if these can be resumed. Finally, the index is saved.
+func (c *Cache) Close(ctx context.Context) error {
+	c.downloadsLock.Lock()
+	downloads := make([]*Download, 0, len(c.downloads))
+	for _, d := range c.downloads {
+		downloads = append(downloads, d)
+	}
+	c.downloadsLock.Unlock()
+
+	if len(downloads) > 0 {
+		log.Infof("waiting for %v downloads to finish", len(downloads))
+	}
+	for _, d := range downloads {
+		select {
+		case <-d.ended:
+			continue
+		case <-ctx.Done():
+		}
+		log.Infof("aborting download of %v: %v", d.Name, errShuttingDown)
+		d.abort(errShuttingDown)
+		<-d.ended
+	}
+	return c.saveIndex()
+}
+
+// attachReader registers a new reader of the download
+func (c *Cache) attachReader(d *Download) {
+	c.downloadsLock.Lock()
+	defer c.downloadsLock.Unlock()
+
+	d.lock.Lock()
+	d.readers++
+	d.lock.Unlock()
+
+	c.acquire(d.Name)
+	c.unorphan(d)
+}
+
+// detachReader drops a reader of the download, the download becomes orphaned
+// once the last reader is gone
+func (c *Cache) detachReader(d *Download) {
+	c.downloadsLock.Lock()
+	defer c.downloadsLock.Unlock()
+
+	d.lock.Lock()
+	d.readers--
+	orphaned := d.readers == 0 && !d.done && !d.finishing
+	d.lock.Unlock()
+
+	c.release(d.Name)
+
+	if !orphaned || d.orphaned {
+		return
+	}
+
+	if c.MaxOrphans > 0 && c.orphans >= c.MaxOrphans {
+		log.Infof("aborting download of %v: %v", d.Name, errTooManyOrphans)
+		d.abort(errTooManyOrphans)
+		return
+	}
+
+	log.Debugf("download of %v is orphaned", d.Name)
+	d.orphaned = true
+	c.orphans++
+	if c.OrphanTimeout > 0 {
+		d.orphanTimer = time.AfterFunc(c.OrphanTimeout, func() {
+			log.Infof("aborting download of %v: %v", d.Name, errOrphanTimeout)
+			d.abort(errOrphanTimeout)
+		})
+	}
+}
+
+func (c *Cache) unorphan(d *Download) {
+	if !d.orphaned {
+		return
+	}
+	d.orphaned = false
+	c.orphans--
+	if d.orphanTimer != nil {
+		d.orphanTimer.Stop()
+		d.orphanTimer = nil
+	}
+}
+
+// Context returns the context of the download, which is cancelled when the
+// download is aborted or finished.
+func (d *Download) Context() context.Context {
+	return d.ctx
+}
+
+// abort cancels the download, the error is reported to its readers
+func (d *Download) abort(err error) {
+	d.lock.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.lock.Unlock()
+	d.cancel()
+}
+
+// Begin prepares a cache entry for the data obtained from given URL and
+// described by the headers. When offset is non 0, the download resumes after
+// the partial data that is already in the cache. Once started, the download
+// can be followed by readers.
+func (d *Download) Begin(url string, header http.Header, offset int64) error {
+	if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		d.cache.reserve(size - offset)
+	}
+
+	info := PartialInfo{
+		URL:          url,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	}
+	out, err := d.cache.PutPartial(d.Name, info, offset)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.out = out
+	d.header = header
+	d.written = offset
+	d.cond.Broadcast()
+	return nil
+}
+
+// Continue carries on with a download that has started, with the remaining
+// data obtained from another upstream location.
+func (d *Download) Continue(url string, header http.Header) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.out.info.URL = url
+	d.out.info.ETag = header.Get("ETag")
+	if lm := header.Get("Last-Modified"); lm != "" {
+		d.out.info.LastModified = lm
+	}
+	if err := d.out.saveInfo(d.out.info); err != nil {
+		log.Errorf("cannot save partial data info of %v: %v", d.Name, err)
+	}
+}
+
+// Progress returns the information about the data obtained so far and whether
+// the download has started. For a download that has not started yet, this is
+// the partial data kept in the cache, if any.
+func (d *Download) Progress() (info *PartialInfo, started bool, err error) {
+	d.lock.Lock()
+	if d.out != nil {
+		info := d.out.info
+		info.Size = d.written
+		d.lock.Unlock()
+		return &info, true, nil
+	}
+	d.lock.Unlock()
+
+	info, err = d.cache.GetPartial(d.Name)
+	return info, false, err
+}
+
+// ExpectedSize returns the size of the data as announced when the download
+// was started, or -1 if unknown.
+func (d *Download) ExpectedSize() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.header == nil {
+		return -1
+	}
+	size, err := strconv.ParseInt(d.header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// Written returns the size of the data obtained so far, including the partial
+// data the download was resumed from.
+func (d *Download) Written() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.written
+}
+
+func (d *Download) Write(data []byte) (int, error) {
+	n, err := d.out.Write(data)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.written += int64(n)
+	d.cond.Broadcast()
+	return n, err
+}
+
+// Finish completes the download. If err is nil, the data is committed to the
+// cache, otherwise the readers will observe the error and the data is either
+// kept so that the download can be resumed later, or discarded. Calling Finish
+// on a download that has already finished is a no-op.
+func (d *Download) Finish(err error) error {
+	d.lock.Lock()
+	if d.done || d.finishing {
+		d.lock.Unlock()
+		return nil
+	}
+
+	if d.err != nil {
+		// the download was aborted, the original reason takes precedence
+		err = d.err
+	}
+	out, written := d.out, d.written
+	resumable := out != nil && err != nil && d.resumable()
+	if out != nil && err == nil {
+		out.Meta = EntryMeta{
+			ContentType:  d.header.Get("Content-Type"),
+			ETag:         out.info.ETag,
+			LastModified: out.info.LastModified,
+			Mirror:       out.info.URL,
+		}
+	}
+	// the data is put in place without the lock held, so that the readers
+	// can carry on with the data written so far
+	d.finishing = true
+	d.lock.Unlock()
+
+	var finishErr error
+	switch {
+	case out == nil && err == nil:
+		err = errDownloadNotStarted
+	case out == nil:
+	case err == nil:
+		finishErr = out.Commit()
+		err = finishErr
+	case resumable:
+		log.Errorf("download of %v failed: %v, keeping %v bytes for resuming", d.Name, err, written)
+		finishErr = out.Suspend()
+	default:
+		log.Errorf("download of %v failed: %v, discarding cache entry", d.Name, err)
+		finishErr = out.Abort()
+	}
+
+	d.lock.Lock()
+	d.finishing = false
+	d.done = true
+	d.err = err
+	d.cond.Broadcast()
+	d.lock.Unlock()
+
+	d.cache.endDownload(d)
+	return finishErr
+}
+
+func (d *Download) resumable() bool {
+	// more data than announced cannot be trusted
+	if size, err := strconv.ParseInt(d.header.Get("Content-Length"), 10, 64); err == nil && d.written > size {
+		return false
+	}
+	info := d.out.info
+	info.Size = d.written
+	return info.Resumable()
+}
+
+// Follow waits for the download to start and returns the headers of the
+// upstream response along with a reader of the data. The reader returns
+// io.EOF once all the data has been committed to the cache, or the error the
+// download failed with. Waiting is interrupted when the context is done.
+func (d *Download) Follow(ctx context.Context) (http.Header, *DownloadReader, error) {
+	d.cache.attachReader(d)
+
+	r := &DownloadReader{
+		d:    d,
+		ctx:  ctx,
+		stop: make(chan struct{}),
+	}
+	// wake up the reader when the context is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.lock.Lock()
+			d.cond.Broadcast()
+			d.lock.Unlock()
+		case <-r.stop:
+		}
+	}()
+
+	header, f, err := r.open()
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	r.f = f
+	return header, r, nil
+}
+
+// DownloadReader follows the data of a download as it is being written.
+type DownloadReader struct {
+	d      *Download
+	f      StorageReader
+	ctx    context.Context
+	stop   chan struct{}
+	offset int64
+}
+
+func (r *DownloadReader) open() (http.Header, StorageReader, error) {
+	d := r.d
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for (d.out == nil && !d.done || d.finishing) && r.ctx.Err() == nil {
+		d.cond.Wait()
+	}
+	if err := r.ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if d.done && d.err != nil {
+		return nil, nil, d.err
+	}
+
+	// the temporary object is committed without the lock held, having
+	// waited for it to finish we either open the temporary object or the
+	// committed one
+	var f StorageReader
+	var err error
+	if d.done {
+		f, _, err = d.cache.storage().Get(d.Name)
+	} else {
+		f, err = d.out.open()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.header, f, nil
+}
+
+func (r *DownloadReader) Read(p []byte) (int, error) {
+	d := r.d
+
+	d.lock.Lock()
+	for r.offset >= d.written && !d.done && r.ctx.Err() == nil {
+		d.cond.Wait()
+	}
+	written, done, err := d.written, d.done, d.err
+	d.lock.Unlock()
+
+	if r.offset >= written {
+		if !done {
+			return 0, r.ctx.Err()
+		}
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if avail := written - r.offset; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	return r.readFile(p)
+}
+
+func (r *DownloadReader) readFile(p []byte) (int, error) {
+	n, err := r.f.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err != nil && n > 0 {
+		// data was read, report the error on next call
+		err = nil
+	}
+	return n, err
+}
+
+func (r *DownloadReader) Close() error {
+	close(r.stop)
+	r.d.cache.detachReader(r.d)
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,404 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadStartOnce(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-download-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	d, isNew := c.StartDownload("foo")
+	require.NotNil(t, d)
+	assert.True(t, isNew)
+
+	d2, isNew := c.StartDownload("foo")
+	assert.False(t, isNew)
+	assert.True(t, d == d2)
+
+	// a different entry gets its own download
+	d3, isNew := c.StartDownload("bar")
+	assert.True(t, isNew)
+	assert.False(t, d == d3)
+
+	err = d.Finish(errors.New("failed"))
+	assert.NoError(t, err)
+
+	// once finished, a new download can be started
+	d4, isNew := c.StartDownload("foo")
+	assert.True(t, isNew)
+	assert.False(t, d == d4)
+}
+
+func TestDownloadFollow(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-download-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	d, _ := c.StartDownload("foo")
+	err = d.Begin("", http.Header{"Content-Type": []string{"application/foo"}}, 0)
+	require.NoError(t, err)
+
+	_, err = d.Write([]byte("hello "))
+	require.NoError(t, err)
+
+	hdr, rd, err := d.Follow(context.Background())
+	require.NoError(t, err)
+	defer rd.Close()
+	assert.Equal(t, "application/foo", hdr.Get("Content-Type"))
+
+	buf := make([]byte, 100)
+	n, err := rd.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello ", string(buf[:n]))
+
+	readDone := make(chan []byte)
+	go func() {
+		data, err := ioutil.ReadAll(rd)
+		assert.NoError(t, err)
+		readDone <- data
+	}()
+
+	_, err = d.Write([]byte("world"))
+	require.NoError(t, err)
+	err = d.Finish(nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("world"), <-readDone)
+
+	data, err := ioutil.ReadFile(filepath.Join(td, "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello world"), data)
+
+	// following a committed download reads the cache entry
+	_, rd2, err := d.Follow(context.Background())
+	require.NoError(t, err)
+	defer rd2.Close()
+	data, err = ioutil.ReadAll(rd2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello world"), data)
+}
+
+func TestDownloadFinishUnlocked(t *testing.T) {
+	s := &pausingStorage{MemoryStorage: &MemoryStorage{}}
+	c := Cache{Storage: s}
+
+	d, _ := c.StartDownload("foo")
+	require.NoError(t, d.Begin("", http.Header{}, 0))
+	_, err := d.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, rd, err := d.Follow(context.Background())
+	require.NoError(t, err)
+	defer rd.Close()
+
+	s.prepared, s.release = make(chan struct{}), make(chan struct{})
+	finished := make(chan error)
+	go func() {
+		finished <- d.Finish(nil)
+	}()
+	<-s.prepared
+
+	// the data written so far can be read while it is being committed
+	read := make(chan string)
+	go func() {
+		buf := make([]byte, 100)
+		n, err := rd.Read(buf)
+		assert.NoError(t, err)
+		read <- string(buf[:n])
+	}()
+	select {
+	case data := <-read:
+		assert.Equal(t, "hello", data)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("download not read while being committed")
+	}
+	assert.Equal(t, int64(5), d.Written())
+
+	// new readers open the committed entry
+	opened := make(chan string)
+	go func() {
+		_, rd, err := d.Follow(context.Background())
+		if !assert.NoError(t, err) {
+			close(opened)
+			return
+		}
+		defer rd.Close()
+		data, err := ioutil.ReadAll(rd)
+		assert.NoError(t, err)
+		opened <- string(data)
+	}()
+
+	close(s.release)
+	require.NoError(t, <-finished)
+	assert.Equal(t, "hello", <-opened)
+	_, err = rd.Read(make([]byte, 100))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDownloadFollowFailed(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-download-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	d, _ := c.StartDownload("foo")
+
+	// follow blocks until the download either starts or fails
+	followErr := make(chan error)
+	go func() {
+		_, _, err := d.Follow(context.Background())
+		followErr <- err
+	}()
+	err = d.Finish(errors.New("mock failure"))
+	assert.NoError(t, err)
+	assert.EqualError(t, <-followErr, "mock failure")
+
+	d, _ = c.StartDownload("bar")
+	err = d.Begin("", http.Header{}, 0)
+	require.NoError(t, err)
+	_, err = d.Write([]byte("partial"))
+	require.NoError(t, err)
+
+	_, rd, err := d.Follow(context.Background())
+	require.NoError(t, err)
+	defer rd.Close()
+
+	err = d.Finish(errors.New("mock transfer failure"))
+	assert.NoError(t, err)
+
+	// data written so far is still readable, then the error is reported
+	data, err := ioutil.ReadAll(rd)
+	assert.EqualError(t, err, "mock transfer failure")
+	assert.Equal(t, []byte("partial"), data)
+
+	_, err = os.Stat(filepath.Join(td, "bar"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadFinishNotStarted(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-download-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	d, _ := c.StartDownload("foo")
+	err = d.Finish(nil)
+	assert.NoError(t, err)
+
+	_, _, err = d.Follow(context.Background())
+	assert.Equal(t, errDownloadNotStarted, err)
+}
+
+func TestDownloadOrphaned(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-download-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	d, _ := c.StartDownload("foo")
+	err = d.Begin("", http.Header{}, 0)
+	require.NoError(t, err)
+
+	_, rd, err := d.Follow(context.Background())
+	require.NoError(t, err)
+	_, err = d.Write([]byte("foo"))
+	require.NoError(t, err)
+	// the reader goes away
+	rd.Close()
+	assert.Equal(t, 1, c.orphans)
+
+	// the download continues
+	_, err = d.Write([]byte("bar"))
+	require.NoError(t, err)
+	err = d.Finish(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, c.orphans)
+
+	data, err := ioutil.ReadFile(filepath.Join(td, "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("foobar"), data)
+}
+
+func TestDownloadTooManyOrphans(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-download-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td, MaxOrphans: 1}
+
+	orphan := func(name string) *Download {
+		d, _ := c.StartDownload(name)
+		err := d.Begin("", http.Header{}, 0)
+		require.NoError(t, err)
+		_, rd, err := d.Follow(context.Background())
+		require.NoError(t, err)
+		rd.Close()
+		return d
+	}
+
+	d1 := orphan("foo")
+	assert.NoError(t, d1.Context().Err())
+	assert.Equal(t, 1, c.orphans)
+
+	// the limit is reached, the next orphaned download is aborted
+	d2 := orphan("bar")
+	assert.Error(t, d2.Context().Err())
+	assert.Equal(t, 1, c.orphans)
+	err = d2.Finish(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, errTooManyOrphans, d2.err)
+	_, err = os.Stat(filepath.Join(td, "bar"))
+	assert.True(t, os.IsNotExist(err))
+
+	// a reader is back, the download is no longer orphaned
+	_, rd, err := d1.Follow(context.Background())
+	require.NoError(t, err)
+	defer rd.Close()
+	assert.Equal(t, 0, c.orphans)
+
+	d3 := orphan("baz")
+	assert.NoError(t, d3.Context().Err())
+	assert.Equal(t, 1, c.orphans)
+}
+
+func TestDownloadOrphanTimeout(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-download-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td, OrphanTimeout: 10 * time.Millisecond}
+
+	d, _ := c.StartDownload("foo")
+	err = d.Begin("", http.Header{}, 0)
+	require.NoError(t, err)
+	_, rd, err := d.Follow(context.Background())
+	require.NoError(t, err)
+	rd.Close()
+
+	select {
+	case <-d.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("download not cancelled")
+	}
+	err = d.Finish(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, errOrphanTimeout, d.err)
+	assert.Equal(t, 0, c.orphans)
+}
+
+func TestDownloadFailedKeepsPartial(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-download-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	d, _ := c.StartDownload("foo")
+	err = d.Begin("http://mirror/foo", http.Header{"Etag": []string{`"1234"`}}, 0)
+	require.NoError(t, err)
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	err = d.Finish(errors.New("mock failure"))
+	require.NoError(t, err)
+
+	pi, err := c.GetPartial("foo")
+	require.NoError(t, err)
+	assert.Equal(t, &PartialInfo{URL: "http://mirror/foo", ETag: `"1234"`, Size: 5}, pi)
+
+	// no validators, the data cannot be resumed
+	d, _ = c.StartDownload("bar")
+	err = d.Begin("http://mirror/bar", http.Header{}, 0)
+	require.NoError(t, err)
+	_, err = d.Write([]byte("hello"))
+	require.NoError(t, err)
+	err = d.Finish(errors.New("mock failure"))
+	require.NoError(t, err)
+
+	_, err = c.GetPartial("bar")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCacheClose(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-download-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	// finishes within the grace period
+	done, _ := c.StartDownload("done")
+	require.NoError(t, done.Begin("http://mirror/done", http.Header{}, 0))
+	// keeps going until aborted
+	stuck, _ := c.StartDownload("stuck")
+	require.NoError(t, stuck.Begin("http://mirror/stuck", http.Header{"Etag": []string{`"1234"`}}, 0))
+	_, err = stuck.Write([]byte("hel"))
+	require.NoError(t, err)
+
+	go func() {
+		done.Write([]byte("done"))
+		done.Finish(nil)
+	}()
+	go func() {
+		<-stuck.Context().Done()
+		stuck.Finish(errors.New("request cancelled"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, c.Close(ctx))
+
+	r, _, err := c.Get("done")
+	require.NoError(t, err)
+	assert.Equal(t, "done", readAll(t, r))
+	r.Close()
+
+	// the aborted download can be resumed
+	assert.Equal(t, errShuttingDown, stuck.err)
+	pi, err := c.GetPartial("stuck")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), pi.Size)
+
+	// the index is saved
+	_, err = os.Stat(filepath.Join(td, c.getIndexName()))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,265 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileStorage keeps the objects as files in a directory
+type FileStorage struct {
+	Dir string
+}
+
+// temporarySuffix matches the suffix added by ioutil.TempFile to the names of
+// temporary files created by FileStorage.Put
+var temporarySuffix = regexp.MustCompile(`\.part\.[0-9]+$`)
+
+// isTemporary returns true if the name refers to a temporary file created by
+// FileStorage.Put
+func isTemporary(name string) bool {
+	return temporarySuffix.MatchString(path.Base(name))
+}
+
+func (s *FileStorage) path(name string) string {
+	return path.Join(s.Dir, name)
+}
+
+func (s *FileStorage) Get(name string) (StorageReader, StorageInfo, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, StorageInfo{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, StorageInfo{}, err
+	}
+	return f, fileStorageInfo(fi), nil
+}
+
+func (s *FileStorage) Stat(name string) (StorageInfo, error) {
+	fi, err := os.Stat(s.path(name))
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return fileStorageInfo(fi), nil
+}
+
+func fileStorageInfo(fi os.FileInfo) StorageInfo {
+	info := StorageInfo{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		IsDir:   fi.IsDir(),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		info.Links = int(st.Nlink)
+	}
+	return info
+}
+
+func (s *FileStorage) Put(name string) (StorageWriter, error) {
+	fpath := s.path(name)
+	if err := os.MkdirAll(path.Dir(fpath), 0700); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(path.Dir(fpath), path.Base(fpath)+".part.")
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{File: f, storage: s}, nil
+}
+
+func (s *FileStorage) Append(name string, offset int64) (StorageWriter, error) {
+	fpath := s.path(name)
+	if err := os.MkdirAll(path.Dir(fpath), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileWriter{File: f, storage: s, keep: true}, nil
+}
+
+func (s *FileStorage) Delete(name string) error {
+	return os.Remove(s.path(name))
+}
+
+// Link makes a hard link of the file, the files must be on the same file
+// system
+func (s *FileStorage) Link(from, to string) error {
+	fpath := s.path(to)
+	if err := os.MkdirAll(path.Dir(fpath), 0700); err != nil {
+		return err
+	}
+	// the link is made under a temporary name first, so that the existing
+	// file is replaced atomically
+	f, err := ioutil.TempFile(path.Dir(fpath), path.Base(fpath)+".part.")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	tmp := f.Name()
+	if err := os.Remove(tmp); err != nil {
+		return err
+	}
+	if err := os.Link(s.path(from), tmp); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := os.Chtimes(tmp, now, now); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, fpath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Walk visits the files and directories, other than the root directory and
+// the temporary files. The storage is empty if the directory does not exist.
+func (s *FileStorage) Walk(fn StorageWalkFunc) error {
+	walk := func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "cannot process path %v", fpath)
+		}
+		if fpath == s.Dir || isTemporary(fpath) {
+			return nil
+		}
+		name, err := filepath.Rel(s.Dir, fpath)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(name), fileStorageInfo(fi))
+	}
+	if err := filepath.Walk(s.Dir, walk); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	return nil
+}
+
+// RemoveTemporary removes the temporary files, these cannot be resumed as
+// nothing is known about the origin of their data
+func (s *FileStorage) RemoveTemporary() (count int, size int64, err error) {
+	walk := func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "cannot process path %v", fpath)
+		}
+		if fi.IsDir() || !isTemporary(fpath) {
+			return nil
+		}
+		log.Debugf("removing temporary file %v", fpath)
+		if err := os.Remove(fpath); err != nil {
+			log.Errorf("cannot remove temporary file: %v", err)
+			return nil
+		}
+		count++
+		size += fi.Size()
+		return nil
+	}
+	if err := filepath.Walk(s.Dir, walk); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return count, size, err
+	}
+	return count, size, nil
+}
+
+type fileWriter struct {
+	*os.File
+	storage *FileStorage
+	// set for files that are kept when closed
+	keep bool
+	// set once the data is synced and the file closed
+	prepared bool
+}
+
+func (w *fileWriter) Open() (StorageReader, error) {
+	return os.Open(w.Name())
+}
+
+// Prepare syncs the data and closes the file
+func (w *fileWriter) Prepare() error {
+	if w.prepared {
+		return nil
+	}
+	// the data must reach the disk before the file is renamed, otherwise
+	// an entry may be left empty after a crash
+	if err := w.File.Sync(); err != nil {
+		w.File.Close()
+		return err
+	}
+	w.prepared = true
+	return w.File.Close()
+}
+
+func (w *fileWriter) Commit(name string) error {
+	if err := w.Prepare(); err != nil {
+		return err
+	}
+	fpath := w.storage.path(name)
+	if err := os.MkdirAll(path.Dir(fpath), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(w.Name(), fpath); err != nil {
+		log.Errorf("rename %v -> %v failed: %v", w.Name(), fpath, err)
+		return err
+	}
+	return nil
+}
+
+func (w *fileWriter) Abort() error {
+	if !w.prepared {
+		if err := w.File.Close(); err != nil {
+			return err
+		}
+	}
+	return os.Remove(w.Name())
+}
+
+func (w *fileWriter) Close() error {
+	if !w.keep {
+		return w.Abort()
+	}
+	if w.prepared {
+		return nil
+	}
+	return w.File.Close()
+}
@@ -0,0 +1,101 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorage(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-storage-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	testStorage(t, &FileStorage{Dir: td})
+}
+
+func TestFileStorageWalk(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-storage-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	s := &FileStorage{Dir: td}
+
+	// the storage is empty if the directory does not exist
+	missing := &FileStorage{Dir: filepath.Join(td, "missing")}
+	assert.Empty(t, walkNames(t, missing))
+
+	makeFile(t, filepath.Join(td, "foo/bar"), []byte("bar"))
+	makeFile(t, filepath.Join(td, "skipped/baz"), []byte("baz"))
+	// temporary files are not visited
+	w, err := s.Put("foo/new")
+	require.NoError(t, err)
+	defer w.Abort()
+
+	var visited []string
+	err = s.Walk(func(name string, info StorageInfo) error {
+		visited = append(visited, name)
+		if info.IsDir && name == "skipped" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo", "foo/bar", "skipped"}, visited)
+}
+
+func TestFileStorageRemoveTemporary(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-storage-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	s := &FileStorage{Dir: td}
+
+	// left behind when killed while writing
+	makeFile(t, filepath.Join(td, "foo/bar.part.1234"), []byte("bar"))
+	// names that only look like the ones of temporary files
+	makeFile(t, filepath.Join(td, "foo/baz.part.1.tar"), []byte("baz"))
+	makeFile(t, filepath.Join(td, "foo/baz.part.tmp"), []byte("baz"))
+	makeFile(t, filepath.Join(td, "foo/baz.part."), []byte("baz"))
+	// the state directory is scanned too
+	makeFile(t, filepath.Join(td, cacheStateDir, blobsDir, "sha256/ab/abcd"), []byte("abcd"))
+	makeFile(t, filepath.Join(td, cacheStateDir, blobsDir, "sha256/ab/abcd.part.42"), []byte("ab"))
+
+	count, size, err := s.RemoveTemporary()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, int64(5), size)
+	assert.Equal(t, []string{
+		"_viadown/blobs/sha256/ab/abcd",
+		"foo/baz.part.",
+		"foo/baz.part.1.tar",
+		"foo/baz.part.tmp",
+	}, walkNames(t, s))
+	_, err = os.Stat(filepath.Join(td, cacheStateDir, blobsDir, "sha256/ab/abcd.part.42"))
+	assert.True(t, os.IsNotExist(err))
+}
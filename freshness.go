@@ -0,0 +1,155 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// FreshnessRule describes for how long cache entries matching a pattern can be
+// served without consulting upstream
+type FreshnessRule struct {
+	// Pattern is matched against the base name of an entry, or against the
+	// whole name if the pattern contains a /
+	Pattern string
+	// MaxAge is the time since the data was obtained or last revalidated,
+	// during which the entry is fresh
+	MaxAge time.Duration
+	// Immutable entries never change upstream, hence are always fresh
+	Immutable bool
+}
+
+func (r *FreshnessRule) Matches(name string) bool {
+	name = strings.TrimPrefix(name, "/")
+	if !strings.Contains(r.Pattern, "/") {
+		name = path.Base(name)
+	}
+	match, _ := path.Match(r.Pattern, name)
+	return match
+}
+
+// IsFresh returns true if the entry with given metadata is fresh at given time
+func (r *FreshnessRule) IsFresh(meta *EntryMeta, now time.Time) bool {
+	if r.Immutable {
+		return true
+	}
+	if meta == nil {
+		// nothing is known about the entry
+		return false
+	}
+	return now.Sub(meta.Fetched) < r.MaxAge
+}
+
+func (r FreshnessRule) String() string {
+	if r.Immutable {
+		return fmt.Sprintf("%v immutable", r.Pattern)
+	}
+	return fmt.Sprintf("%v %v", r.Pattern, r.MaxAge)
+}
+
+// FreshnessPolicy is a list of rules, the first rule matching an entry applies
+type FreshnessPolicy []FreshnessRule
+
+var DefaultFreshnessPolicy = FreshnessPolicy{
+	// ArchLinux repository databases and packages
+	{Pattern: "*.db", MaxAge: 5 * time.Minute},
+	{Pattern: "*.db.sig", MaxAge: 5 * time.Minute},
+	{Pattern: "*.files", MaxAge: 5 * time.Minute},
+	{Pattern: "*.files.sig", MaxAge: 5 * time.Minute},
+	{Pattern: "*.pkg.tar.*", Immutable: true},
+	// Debian repository indices and packages
+	{Pattern: "InRelease", MaxAge: 5 * time.Minute},
+	{Pattern: "Release", MaxAge: 5 * time.Minute},
+	{Pattern: "Release.gpg", MaxAge: 5 * time.Minute},
+	{Pattern: "Packages*", MaxAge: 5 * time.Minute},
+	{Pattern: "Sources*", MaxAge: 5 * time.Minute},
+	{Pattern: "Contents-*", MaxAge: 5 * time.Minute},
+	{Pattern: "Translation-*", MaxAge: 5 * time.Minute},
+	{Pattern: "*.deb", Immutable: true},
+}
+
+// Rule returns the rule applicable to entry of given name, or nil if there is
+// none
+func (p FreshnessPolicy) Rule(name string) *FreshnessRule {
+	for i := range p {
+		if p[i].Matches(name) {
+			return &p[i]
+		}
+	}
+	return nil
+}
+
+// LoadFreshnessPolicy loads the policy from a file. Each line of the file
+// holds a pattern followed by either the maximum age of matching entries, or
+// the keyword immutable. Empty lines, or lines starting with # are skipped.
+func LoadFreshnessPolicy(fname string) (FreshnessPolicy, error) {
+	log.Debugf("loading freshness policy from file %v", fname)
+
+	f, err := os.Open(fname)
+	if err != nil {
+		log.Errorf("failed to open freshness policy file: %v", err)
+		return nil, err
+	}
+	defer f.Close()
+
+	var policy FreshnessPolicy
+	scan := bufio.NewScanner(f)
+	lineNo := 0
+	for scan.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scan.Text())
+		if strings.HasPrefix(line, "#") || len(line) == 0 {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %v: expected a pattern and maximum age", lineNo)
+		}
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("line %v: invalid pattern %q: %v", lineNo, fields[0], err)
+		}
+		rule := FreshnessRule{Pattern: fields[0]}
+		if fields[1] == "immutable" {
+			rule.Immutable = true
+		} else {
+			maxAge, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %v: invalid maximum age: %v", lineNo, err)
+			}
+			rule.MaxAge = maxAge
+		}
+		policy = append(policy, rule)
+	}
+	if err := scan.Err(); err != nil {
+		log.Errorf("failed to read freshness policy file: %v", err)
+		return nil, err
+	}
+
+	log.Infof("got %v freshness rules", len(policy))
+	return policy, nil
+}
@@ -0,0 +1,114 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreshnessPolicyRule(t *testing.T) {
+	p := FreshnessPolicy{
+		{Pattern: "*.db", MaxAge: 5 * time.Minute},
+		{Pattern: "*.pkg.tar.*", Immutable: true},
+		{Pattern: "debian/dists/*/InRelease", MaxAge: time.Minute},
+	}
+
+	for _, tc := range []struct {
+		name string
+		rule *FreshnessRule
+	}{
+		{"/core/os/x86_64/core.db", &p[0]},
+		{"core.db", &p[0]},
+		{"/core/os/x86_64/core.db.sig", nil},
+		{"/core/os/x86_64/foo-1.0-1-x86_64.pkg.tar.zst", &p[1]},
+		{"/core/os/x86_64/foo-1.0-1-x86_64.pkg.tar.zst.sig", &p[1]},
+		{"/debian/dists/stable/InRelease", &p[2]},
+		{"/ubuntu/dists/stable/InRelease", nil},
+		{"/foo", nil},
+	} {
+		assert.True(t, tc.rule == p.Rule(tc.name), "unexpected rule for %v", tc.name)
+	}
+
+	var none FreshnessPolicy
+	assert.Nil(t, none.Rule("core.db"))
+}
+
+func TestFreshnessRuleIsFresh(t *testing.T) {
+	now := time.Now()
+	r := FreshnessRule{Pattern: "*.db", MaxAge: 5 * time.Minute}
+	assert.True(t, r.IsFresh(&EntryMeta{Fetched: now.Add(-time.Minute)}, now))
+	assert.False(t, r.IsFresh(&EntryMeta{Fetched: now.Add(-time.Hour)}, now))
+	// nothing known about the entry
+	assert.False(t, r.IsFresh(nil, now))
+
+	r = FreshnessRule{Pattern: "*.pkg.tar.*", Immutable: true}
+	assert.True(t, r.IsFresh(&EntryMeta{Fetched: now.Add(-24 * time.Hour)}, now))
+	assert.True(t, r.IsFresh(nil, now))
+}
+
+func TestLoadFreshnessPolicy(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	pf := path.Join(td, "foo")
+	err = ioutil.WriteFile(pf, []byte(`
+# repository databases
+*.db   5m
+
+*.pkg.tar.*    immutable
+`), 0600)
+	require.NoError(t, err)
+
+	p, err := LoadFreshnessPolicy(pf)
+	assert.NoError(t, err)
+	assert.Equal(t, FreshnessPolicy{
+		{Pattern: "*.db", MaxAge: 5 * time.Minute},
+		{Pattern: "*.pkg.tar.*", Immutable: true},
+	}, p)
+
+	for _, tc := range []struct {
+		data, err string
+	}{
+		{"*.db", "line 1: expected a pattern and maximum age"},
+		{"*.db 5m 10m", "line 1: expected a pattern and maximum age"},
+		{"\n*.db forever", `line 2: invalid maximum age: time: invalid duration "forever"`},
+		{"[ 5m", `line 1: invalid pattern "[": syntax error in pattern`},
+	} {
+		err = ioutil.WriteFile(pf, []byte(tc.data), 0600)
+		require.NoError(t, err)
+		p, err = LoadFreshnessPolicy(pf)
+		assert.EqualError(t, err, tc.err)
+		assert.Nil(t, p)
+	}
+
+	p, err = LoadFreshnessPolicy(path.Join(td, "bar"))
+	assert.Error(t, err)
+	assert.Nil(t, p)
+}
@@ -0,0 +1,264 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// quarantineDir is a directory inside the state directory, where the data of
+// corrupt entries is moved to
+const quarantineDir = "quarantine"
+
+// FsckReport is the result of verifying the entries of the cache
+type FsckReport struct {
+	// Checked is the number of entries verified against their digests
+	Checked int
+	// Unverified is the number of entries without a recorded digest
+	Unverified int
+	Corrupt    []CorruptEntry
+}
+
+// CorruptEntry describes an entry found to be corrupt
+type CorruptEntry struct {
+	Name    string
+	Problem string
+}
+
+// FsckStatus is the state of the check of the cache running in the background
+type FsckStatus struct {
+	Running bool
+	// Started and Finished are the times of start and end of the last
+	// check
+	Started  time.Time
+	Finished time.Time
+	// Report of the last check, once finished
+	Report *FsckReport `json:",omitempty"`
+	Error  string      `json:",omitempty"`
+}
+
+// fsckRunner runs the checks of the cache in the background, one at a time
+type fsckRunner struct {
+	lock sync.Mutex
+	last FsckStatus
+	// cancel interrupts the check in progress, done is closed once it has
+	// finished
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start starts a check of the cache, unless one is running already, returns
+// false if it was not started
+func (f *fsckRunner) start(c *Cache) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.last.Running {
+		return false
+	}
+	f.last = FsckStatus{Running: true, Started: time.Now()}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	f.cancel, f.done = cancel, done
+	go func() {
+		defer close(done)
+		defer cancel()
+		report, err := c.Fsck(ctx)
+
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.last.Running = false
+		f.last.Finished = time.Now()
+		f.last.Report = report
+		if err != nil {
+			log.Errorf("cannot check cache: %v", err)
+			f.last.Error = err.Error()
+		}
+	}()
+	return true
+}
+
+// stop interrupts the check in progress, if any, and waits for it to finish
+// until ctx is done
+func (f *fsckRunner) stop(ctx context.Context) error {
+	f.lock.Lock()
+	cancel, done := f.cancel, f.done
+	f.lock.Unlock()
+
+	if done == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// status returns the state of the last check
+func (f *fsckRunner) status() FsckStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.last
+}
+
+func (c *Cache) getQuarantineName(name string) string {
+	return path.Join(cacheStateDir, quarantineDir, name)
+}
+
+// verifyData checks the data against the metadata recorded when the entry
+// was committed, returns a description of the problem, if any, and false if
+// there is no digest to verify the data with
+func verifyData(r io.Reader, size int64, meta *EntryMeta) (problem string, verified bool) {
+	if !strings.HasPrefix(meta.Digest, "sha256:") {
+		return "", false
+	}
+	if size != meta.ContentLength {
+		return fmt.Sprintf("size %v, expected %v", size, meta.ContentLength), true
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return fmt.Sprintf("cannot read data: %v", err), true
+	}
+	if digest := fmt.Sprintf("sha256:%x", h.Sum(nil)); digest != meta.Digest {
+		return fmt.Sprintf("digest %v, expected %v", digest, meta.Digest), true
+	}
+	return "", true
+}
+
+// checkEntryLocked verifies the entry, which must be locked by the caller
+func (c *Cache) checkEntryLocked(name string) (problem string, verified bool, err error) {
+	s := c.storage()
+	meta, err := readMeta(s, c.getMetaName(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	r, info, err := s.Get(name)
+	if err != nil {
+		return "", false, err
+	}
+	defer r.Close()
+	problem, verified = verifyData(r, info.Size, meta)
+	return problem, verified, nil
+}
+
+func (c *Cache) checkEntry(name string) (problem string, verified bool, err error) {
+	unlock := c.rlockEntry(name)
+	defer unlock()
+
+	return c.checkEntryLocked(name)
+}
+
+// Fsck verifies all the entries of the cache against the digests recorded
+// when they were committed, the corrupt entries are quarantined. The check is
+// interrupted when ctx is done.
+func (c *Cache) Fsck(ctx context.Context) (*FsckReport, error) {
+	entries, err := c.walkEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FsckReport{Corrupt: []CorruptEntry{}}
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			log.Infof("cache check interrupted: %v", err)
+			return nil, err
+		}
+		problem, verified, err := c.checkEntry(e.name)
+		switch {
+		case os.IsNotExist(err):
+			// removed in the meantime
+			continue
+		case err != nil:
+			problem, verified = err.Error(), true
+		}
+		if !verified {
+			report.Unverified++
+			continue
+		}
+		report.Checked++
+		if problem == "" {
+			continue
+		}
+		log.Errorf("cache entry %v is corrupt: %v", e.name, problem)
+		corrupt, err := c.quarantine(e.name)
+		if err != nil {
+			log.Errorf("cannot quarantine %v: %v", e.name, err)
+		}
+		if corrupt {
+			report.Corrupt = append(report.Corrupt, CorruptEntry{
+				Name:    e.name,
+				Problem: problem,
+			})
+		}
+	}
+	log.Infof("cache check: %v entries verified, %v without digest, %v corrupt",
+		report.Checked, report.Unverified, len(report.Corrupt))
+	return report, nil
+}
+
+// quarantine moves the data of a corrupt entry to the quarantine directory and
+// removes the entry, unless it was replaced in the meantime, returns false if
+// the entry is no longer corrupt
+func (c *Cache) quarantine(name string) (bool, error) {
+	unlock := c.lockEntry(name)
+	defer unlock()
+
+	problem, verified, err := c.checkEntryLocked(name)
+	if os.IsNotExist(err) || (err == nil && (!verified || problem == "")) {
+		return false, nil
+	}
+	c.corrupt()
+
+	s := c.storage()
+	qname := c.getQuarantineName(name)
+	if err := copyObject(s, name, qname); err != nil {
+		// the data may not be readable at all
+		log.Errorf("cannot copy %v to quarantine: %v", name, err)
+	} else {
+		log.Infof("corrupt entry %v moved to %v", name, qname)
+	}
+	// the blob shares the same data
+	if meta, err := readMeta(s, c.getMetaName(name)); err == nil {
+		c.dropBlob(meta.Digest)
+	}
+	if err := c.removeEntryLocked(name); err != nil && !os.IsNotExist(err) {
+		return true, errors.Wrap(err, "cannot remove entry")
+	}
+	return true, nil
+}
@@ -0,0 +1,150 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyData(t *testing.T) {
+	meta := &EntryMeta{ContentLength: 4, Digest: digestOf("1234")}
+
+	for _, tc := range []struct {
+		data     string
+		meta     *EntryMeta
+		problem  string
+		verified bool
+	}{
+		{data: "1234", meta: meta, verified: true},
+		{data: "", meta: meta, problem: "size 0, expected 4", verified: true},
+		{data: "4321", meta: meta, problem: "digest " + digestOf("4321") + ", expected " + digestOf("1234"), verified: true},
+		// no digest recorded
+		{data: "", meta: &EntryMeta{ContentLength: 4}},
+		{data: "1234", meta: &EntryMeta{ContentLength: 4, Digest: "md5:1234"}},
+	} {
+		problem, verified := verifyData(strings.NewReader(tc.data), int64(len(tc.data)), tc.meta)
+		assert.Equal(t, tc.problem, problem, "data %q", tc.data)
+		assert.Equal(t, tc.verified, verified, "data %q", tc.data)
+	}
+}
+
+func TestCacheFsck(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-fsck-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	putEntry(t, &c, "good", "1234")
+	putEntry(t, &c, "empty", "5678")
+	putEntry(t, &c, "foo/changed", "abcd")
+	// left behind by an older version, without metadata
+	makeFile(t, filepath.Join(td, "legacy"), []byte("legacy"))
+
+	// the data is lost, or changed behind our back
+	makeFile(t, filepath.Join(td, "empty"), nil)
+	makeFile(t, filepath.Join(td, "foo/changed"), []byte("dcba"))
+
+	report, err := c.Fsck(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &FsckReport{
+		Checked:    3,
+		Unverified: 1,
+		Corrupt: []CorruptEntry{
+			{Name: "empty", Problem: "size 0, expected 4"},
+			{Name: "foo/changed", Problem: "digest " + digestOf("dcba") + ", expected " + digestOf("abcd")},
+		},
+	}, report)
+	assert.Equal(t, 2, c.Stats().Corrupt)
+
+	// the corrupt entries are out of the way, with their data kept in
+	// quarantine
+	assertEntries(t, &c, []string{"good", "legacy"}, []string{"empty", "foo/changed"})
+	data, err := ioutil.ReadFile(filepath.Join(td, c.getQuarantineName("foo/changed")))
+	require.NoError(t, err)
+	assert.Equal(t, "dcba", string(data))
+	_, err = os.Stat(filepath.Join(td, c.getQuarantineName("empty")))
+	assert.NoError(t, err)
+
+	// quarantined data is not an entry
+	report, err = c.Fsck(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &FsckReport{Checked: 1, Unverified: 1, Corrupt: []CorruptEntry{}}, report)
+}
+
+func TestCacheFsckShared(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-fsck-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	putEntry(t, &c, "foo", "1234")
+	putEntry(t, &c, "bar", "1234")
+	// the data shared by both entries is damaged in place
+	require.NoError(t, ioutil.WriteFile(filepath.Join(td, "foo"), []byte("4321"), 0644))
+
+	report, err := c.Fsck(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, report.Corrupt, 2)
+	// new entries of the same contents do not share the damaged data
+	_, err = os.Stat(filepath.Join(td, getBlobName(digestOf("1234"))))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCacheVerifyHits(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-fsck-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td, VerifyHits: 1}
+
+	putEntry(t, &c, "good", "1234")
+	putEntry(t, &c, "bad", "5678")
+	makeFile(t, filepath.Join(td, "bad"), []byte("56"))
+
+	r, _, err := c.Get("good")
+	require.NoError(t, err)
+	// the data is served from the start after verification
+	assert.Equal(t, "1234", readAll(t, r))
+	r.Close()
+
+	// corrupt entry is not served, and is obtained again
+	_, _, err = c.Get("bad")
+	assert.True(t, os.IsNotExist(err))
+	assertEntries(t, &c, nil, []string{"bad"})
+	_, err = os.Stat(filepath.Join(td, c.getQuarantineName("bad")))
+	assert.NoError(t, err)
+
+	stats := c.Stats()
+	assert.Equal(t, 1, stats.Corrupt)
+	assert.Equal(t, 1, stats.Hit)
+	assert.Equal(t, 1, stats.Miss)
+}
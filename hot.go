@@ -0,0 +1,155 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// hotTier keeps the data of small, frequently used entries in memory, in front
+// of the storage
+type hotTier struct {
+	lock sync.Mutex
+	// most recently used entries are at the front
+	lru     *list.List
+	entries map[string]*list.Element
+	total   int64
+	// incremented whenever an entry is invalidated, the data obtained
+	// from the storage before then may be out of date
+	seq uint64
+}
+
+type hotEntry struct {
+	name    string
+	data    []byte
+	modTime time.Time
+	// metadata of the entry, if obtained
+	meta *EntryMeta
+}
+
+// hotReader reads the data of an entry kept in memory
+type hotReader struct {
+	*bytes.Reader
+}
+
+func (r hotReader) Close() error {
+	return nil
+}
+
+// sequence returns the current invalidation sequence, to be passed when adding
+// data obtained from the storage
+func (h *hotTier) sequence() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.seq
+}
+
+// get returns the entry of given name, or nil if it is not kept
+func (h *hotTier) get(name string) *hotEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	el, ok := h.entries[indexKey(name)]
+	if !ok {
+		return nil
+	}
+	h.lru.MoveToFront(el)
+	return el.Value.(*hotEntry)
+}
+
+// put keeps the data of an entry obtained from the storage, unless any entry
+// was invalidated since seq was obtained. The least recently used entries are
+// dropped so that the total size stays within maxSize.
+func (h *hotTier) put(name string, data []byte, modTime time.Time, seq uint64, maxSize int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.seq != seq || int64(len(data)) > maxSize {
+		return
+	}
+	if h.entries == nil {
+		h.entries = make(map[string]*list.Element)
+		h.lru = list.New()
+	}
+	name = indexKey(name)
+	if el, ok := h.entries[name]; ok {
+		h.dropLocked(el)
+	}
+	for el := h.lru.Back(); el != nil && h.total+int64(len(data)) > maxSize; el = h.lru.Back() {
+		h.dropLocked(el)
+	}
+	h.entries[name] = h.lru.PushFront(&hotEntry{
+		name:    name,
+		data:    data,
+		modTime: modTime,
+	})
+	h.total += int64(len(data))
+}
+
+// putMeta attaches the metadata to an entry that is kept, unless any entry was
+// invalidated since seq was obtained
+func (h *hotTier) putMeta(name string, meta *EntryMeta, seq uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.seq != seq {
+		return
+	}
+	if el, ok := h.entries[indexKey(name)]; ok {
+		m := *meta
+		el.Value.(*hotEntry).meta = &m
+	}
+}
+
+// getMeta returns a copy of the metadata of an entry, or nil if it is not kept
+func (h *hotTier) getMeta(name string) *EntryMeta {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	el, ok := h.entries[indexKey(name)]
+	if !ok || el.Value.(*hotEntry).meta == nil {
+		return nil
+	}
+	m := *el.Value.(*hotEntry).meta
+	return &m
+}
+
+// invalidate drops the entry, its data or metadata have changed
+func (h *hotTier) invalidate(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.seq++
+	if el, ok := h.entries[indexKey(name)]; ok {
+		h.dropLocked(el)
+	}
+}
+
+func (h *hotTier) dropLocked(el *list.Element) {
+	e := el.Value.(*hotEntry)
+	h.total -= int64(len(e.data))
+	h.lru.Remove(el)
+	delete(h.entries, e.name)
+}
@@ -0,0 +1,163 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getData(t *testing.T, c *Cache, name string) string {
+	r, size, err := c.Get(name)
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), size)
+	return string(data)
+}
+
+func TestCacheHotTier(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-hot-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td, HotMaxSize: 10, HotMaxEntrySize: 6}
+
+	makeFile(t, filepath.Join(td, "core.db"), []byte("core"))
+	makeFile(t, filepath.Join(td, "big.pkg"), []byte("1234567"))
+
+	assert.Equal(t, "core", getData(t, &c, "core.db"))
+	assert.Equal(t, CacheStats{Hit: 1, HotMiss: 1}, c.Stats())
+	// served from memory from now on
+	assert.Equal(t, "core", getData(t, &c, "/core.db"))
+	assert.Equal(t, CacheStats{Hit: 2, HotHit: 1, HotMiss: 1}, c.Stats())
+	// the use is tracked as usual
+	assert.Equal(t, 2, indexEntryOf(t, &c, "core.db").hits)
+
+	// entries that are too big are always read from the storage
+	assert.Equal(t, "1234567", getData(t, &c, "big.pkg"))
+	assert.Equal(t, "1234567", getData(t, &c, "big.pkg"))
+	assert.Equal(t, CacheStats{Hit: 4, HotHit: 1, HotMiss: 3}, c.Stats())
+	assert.Equal(t, int64(4), c.hot.total)
+
+	// replacing the entry invalidates the data in memory
+	putEntry(t, &c, "core.db", "new")
+	assert.Equal(t, "new", getData(t, &c, "core.db"))
+	assert.Equal(t, "new", getData(t, &c, "core.db"))
+	assert.Equal(t, CacheStats{Hit: 6, HotHit: 2, HotMiss: 4}, c.Stats())
+
+	// the least recently used entries are dropped to stay within the limit
+	putEntry(t, &c, "extra.db", "extra")
+	putEntry(t, &c, "community.db", "comm")
+	getData(t, &c, "extra.db")
+	getData(t, &c, "community.db")
+	assert.Nil(t, c.hot.get("core.db"))
+	assert.NotNil(t, c.hot.get("extra.db"))
+	assert.Equal(t, int64(9), c.hot.total)
+
+	// so does removing the entry
+	removed, err := c.Purge(PurgeSelector{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), removed)
+	_, _, err = c.Get("extra.db")
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int64(0), c.hot.total)
+}
+
+func TestCacheHotTierMinHits(t *testing.T) {
+	c := Cache{Storage: &MemoryStorage{}, HotMaxSize: 10, HotMinHits: 2}
+
+	putEntry(t, &c, "core.db", "core")
+	putEntry(t, &c, "once.pkg", "once")
+
+	// a single hit does not bring the entry to memory
+	assert.Equal(t, "once", getData(t, &c, "once.pkg"))
+	assert.Nil(t, c.hot.get("once.pkg"))
+	assert.Equal(t, "core", getData(t, &c, "core.db"))
+	assert.Nil(t, c.hot.get("core.db"))
+	assert.Equal(t, int64(0), c.hot.total)
+
+	// but the next one does
+	assert.Equal(t, "core", getData(t, &c, "core.db"))
+	assert.NotNil(t, c.hot.get("core.db"))
+	assert.Equal(t, "core", getData(t, &c, "core.db"))
+	assert.Equal(t, CacheStats{Hit: 4, HotHit: 1, HotMiss: 3}, c.Stats())
+	assert.Nil(t, c.hot.get("once.pkg"))
+}
+
+func TestCacheHotTierMeta(t *testing.T) {
+	c := Cache{Storage: &MemoryStorage{}, HotMaxSize: 10}
+
+	ct, err := c.Put("core.db")
+	require.NoError(t, err)
+	ct.Meta.ETag = `"1"`
+	_, err = ct.WriteString("core")
+	require.NoError(t, err)
+	require.NoError(t, ct.Commit())
+
+	getData(t, &c, "core.db")
+	meta, err := c.GetMeta("core.db")
+	require.NoError(t, err)
+	assert.Equal(t, `"1"`, meta.ETag)
+	// the copy kept in memory is not affected
+	meta.ETag = "changed"
+	meta, err = c.GetMeta("core.db")
+	require.NoError(t, err)
+	assert.Equal(t, `"1"`, meta.ETag)
+	assert.NotNil(t, c.hot.getMeta("core.db"))
+
+	header := http.Header{}
+	header.Set("ETag", `"2"`)
+	require.NoError(t, c.Revalidated("core.db", "", header, time.Now()))
+	meta, err = c.GetMeta("core.db")
+	require.NoError(t, err)
+	assert.Equal(t, `"2"`, meta.ETag)
+}
+
+func TestHotTierStale(t *testing.T) {
+	var h hotTier
+
+	seq := h.sequence()
+	// the entry is invalidated while its data is being read
+	h.invalidate("foo")
+	h.put("foo", []byte("old"), time.Now(), seq, 10)
+	assert.Nil(t, h.get("foo"))
+
+	seq = h.sequence()
+	h.put("foo", []byte("new"), time.Now(), seq, 10)
+	require.NotNil(t, h.get("foo"))
+	assert.Equal(t, []byte("new"), h.get("foo").data)
+	h.putMeta("foo", &EntryMeta{ETag: "foo"}, seq)
+	assert.Equal(t, &EntryMeta{ETag: "foo"}, h.getMeta("foo"))
+
+	h.invalidate("bar")
+	h.putMeta("foo", &EntryMeta{ETag: "stale"}, seq)
+	assert.Equal(t, &EntryMeta{ETag: "foo"}, h.getMeta("foo"))
+}
@@ -0,0 +1,436 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const indexStateFile = "index.json"
+
+// indexSaveDelay is the time after which the changes to the index are saved
+var indexSaveDelay = time.Minute
+
+// indexEntry describes a cache entry, the access time of files cannot be
+// relied on as the cache may be on a file system mounted with noatime, thus
+// the use of entries is tracked in the index
+type indexEntry struct {
+	name string
+	size int64
+	// modTime is the time the data was obtained
+	modTime  time.Time
+	lastUsed time.Time
+	hits     int
+	// digest of the data, set if the data is shared with the entries of
+	// the same digest
+	digest string
+}
+
+// cacheIndex tracks the entries of the cache in the order of their use
+type cacheIndex struct {
+	loaded bool
+	// set when the index was restored from the saved state
+	restored bool
+	// most recently used entries are at the front
+	lru     *list.List
+	entries map[string]*list.Element
+	// total is the size of entries, where the shared data is counted once
+	total int64
+	// number of entries sharing the data of given digest
+	blobs map[string]int
+	// reference count of entries that are being read or written
+	inUse map[string]int
+	// set when saving of the index is pending
+	saveScheduled bool
+}
+
+// indexRecord is the saved state of an entry of the index
+type indexRecord struct {
+	Size       int64
+	ModTime    time.Time
+	LastAccess time.Time
+	Hits       int
+	Digest     string `json:",omitempty"`
+}
+
+// indexKey returns the key under which an entry of given name is tracked,
+// names of entries may or may not start with /
+func indexKey(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "/"))
+}
+
+func (c *Cache) getIndexName() string {
+	return path.Join(cacheStateDir, indexStateFile)
+}
+
+// LoadIndex loads the index of the cache contents. When the index is restored
+// from the saved state, it is then updated in the background with the changes
+// made while the cache was not in use.
+func (c *Cache) LoadIndex() error {
+	c.indexLock.Lock()
+	err := c.loadIndexLocked()
+	restored := c.index.restored
+	c.indexLock.Unlock()
+
+	if err == nil && restored {
+		go func() {
+			if err := c.Reindex(); err != nil {
+				log.Errorf("cannot update cache index: %v", err)
+			}
+		}()
+	}
+	return err
+}
+
+// loadIndexLocked restores the index from the saved state, or builds it from
+// the contents of the storage
+func (c *Cache) loadIndexLocked() error {
+	if c.index.loaded {
+		return nil
+	}
+
+	var entries []indexEntry
+	records, err := c.readIndex()
+	switch {
+	case err == nil && records != nil:
+		entries = make([]indexEntry, 0, len(records))
+		for name, rec := range records {
+			entries = append(entries, indexEntry{
+				name:     name,
+				size:     rec.Size,
+				modTime:  rec.ModTime,
+				lastUsed: rec.LastAccess,
+				hits:     rec.Hits,
+				digest:   rec.Digest,
+			})
+		}
+		c.index.restored = true
+	default:
+		if err != nil {
+			log.Errorf("cannot restore cache index: %v", err)
+		}
+		entries, err = c.walkEntries()
+		if err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+	c.index.lru = list.New()
+	c.index.entries = make(map[string]*list.Element, len(entries))
+	c.index.total = 0
+	c.index.blobs = make(map[string]int)
+	for i := range entries {
+		c.index.entries[entries[i].name] = c.index.lru.PushFront(&entries[i])
+		c.chargeLocked(&entries[i], 1)
+	}
+	c.index.loaded = true
+	log.Infof("cache index: %v entries, %v bytes", len(entries), c.index.total)
+	return nil
+}
+
+// walkEntries collects the entries in the storage, the time of last use is
+// assumed to be the modification time
+func (c *Cache) walkEntries() ([]indexEntry, error) {
+	var entries []indexEntry
+	s := c.storage()
+	walkIndex := func(name string, info StorageInfo) error {
+		if info.IsDir {
+			if name == cacheStateDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, cacheStateDir+"/") {
+			return nil
+		}
+		e := indexEntry{
+			name:     name,
+			size:     info.Size,
+			modTime:  info.ModTime,
+			lastUsed: info.ModTime,
+		}
+		// the data linked with a blob is shared
+		if info.Links > 1 {
+			if meta, err := readMeta(s, c.getMetaName(name)); err == nil {
+				e.digest = meta.Digest
+			}
+		}
+		entries = append(entries, e)
+		return nil
+	}
+	if err := s.Walk(walkIndex); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Reindex updates the index with the contents of the storage, so that
+// the changes made behind the back of the cache are picked up
+func (c *Cache) Reindex() error {
+	start := time.Now()
+	entries, err := c.walkEntries()
+	if err != nil {
+		return err
+	}
+
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if err := c.loadIndexLocked(); err != nil {
+		return err
+	}
+
+	found := make(map[string]bool, len(entries))
+	added := 0
+	for i := range entries {
+		e := &entries[i]
+		found[e.name] = true
+		if el, ok := c.index.entries[e.name]; ok {
+			ie := el.Value.(*indexEntry)
+			// entries committed during the walk are already up to
+			// date
+			if ie.modTime.Before(start) {
+				if e.size != ie.size || !e.modTime.Equal(ie.modTime) {
+					c.hot.invalidate(e.name)
+				}
+				c.chargeLocked(ie, -1)
+				ie.size = e.size
+				ie.modTime = e.modTime
+				ie.digest = e.digest
+				c.chargeLocked(ie, 1)
+			}
+			continue
+		}
+		// not used since the data was obtained
+		c.index.entries[e.name] = c.index.lru.PushBack(e)
+		c.chargeLocked(e, 1)
+		added++
+	}
+	dropped := 0
+	for name, el := range c.index.entries {
+		if found[name] || !el.Value.(*indexEntry).modTime.Before(start) {
+			continue
+		}
+		c.dropLocked(el)
+		c.hot.invalidate(name)
+		dropped++
+	}
+	log.Infof("cache index updated: %v entries added, %v dropped", added, dropped)
+	c.indexChangedLocked()
+	return nil
+}
+
+// readIndex reads the saved state of the index, returns nil if there is none
+func (c *Cache) readIndex() (map[string]indexRecord, error) {
+	data, err := readObject(c.storage(), c.getIndexName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var records map[string]indexRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, errors.Wrap(err, "cannot decode index")
+	}
+	return records, nil
+}
+
+// indexChangedLocked schedules saving of the index
+func (c *Cache) indexChangedLocked() {
+	if c.index.saveScheduled {
+		return
+	}
+	c.index.saveScheduled = true
+	time.AfterFunc(indexSaveDelay, func() {
+		if err := c.saveIndex(); err != nil {
+			log.Errorf("cannot save cache index: %v", err)
+		}
+	})
+}
+
+// saveIndex saves the state of the index
+func (c *Cache) saveIndex() error {
+	c.indexLock.Lock()
+	if !c.index.loaded {
+		c.indexLock.Unlock()
+		return nil
+	}
+	records := make(map[string]indexRecord, len(c.index.entries))
+	for name, el := range c.index.entries {
+		ie := el.Value.(*indexEntry)
+		records[name] = indexRecord{
+			Size:       ie.size,
+			ModTime:    ie.modTime,
+			LastAccess: ie.lastUsed,
+			Hits:       ie.hits,
+			Digest:     ie.digest,
+		}
+	}
+	c.index.saveScheduled = false
+	c.indexLock.Unlock()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	c.indexSaveLock.Lock()
+	defer c.indexSaveLock.Unlock()
+
+	return writeObject(c.storage(), c.getIndexName(), data)
+}
+
+// updateIndexLocked records an entry of given size, obtained at modTime, which
+// is either being hit or has just been committed, returns false if the index
+// could not be updated. The digest of the shared data is recorded when
+// committed.
+func (c *Cache) updateIndexLocked(name string, size int64, modTime time.Time, hit bool, digest string) bool {
+	if err := c.loadIndexLocked(); err != nil {
+		log.Errorf("cannot load cache index: %v", err)
+		return false
+	}
+
+	name = indexKey(name)
+	el, ok := c.index.entries[name]
+	if !ok {
+		el = c.index.lru.PushFront(&indexEntry{name: name})
+		c.index.entries[name] = el
+	}
+	ie := el.Value.(*indexEntry)
+	c.chargeLocked(ie, -1)
+	ie.size = size
+	ie.modTime = modTime
+	ie.lastUsed = time.Now()
+	if hit {
+		ie.hits++
+	} else {
+		ie.digest = digest
+	}
+	c.chargeLocked(ie, 1)
+	c.index.lru.MoveToFront(el)
+	c.indexChangedLocked()
+	return true
+}
+
+// used records a hit of the entry, returns the number of hits of the entry so
+// far
+func (c *Cache) used(name string, size int64, modTime time.Time) int {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if !c.updateIndexLocked(name, size, modTime, true, "") {
+		return 0
+	}
+	return c.index.entries[indexKey(name)].Value.(*indexEntry).hits
+}
+
+// committed records a new entry, possibly replacing an existing one, and
+// evicts other entries if the cache grows over the size limit. The digest is
+// set if the data is shared with other entries.
+func (c *Cache) committed(name string, size int64, digest string) {
+	c.hot.invalidate(name)
+
+	c.indexLock.Lock()
+	var victims []*indexEntry
+	if c.updateIndexLocked(name, size, time.Now(), false, digest) && c.MaxSize != 0 {
+		victims = c.selectVictimsLocked(0, indexKey(name))
+	}
+	c.indexLock.Unlock()
+
+	c.evict(victims)
+}
+
+// removed drops the entry from the index
+func (c *Cache) removed(name string) {
+	c.hot.invalidate(name)
+
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if !c.index.loaded {
+		return
+	}
+	if el, ok := c.index.entries[indexKey(name)]; ok {
+		c.dropLocked(el)
+	}
+}
+
+func (c *Cache) dropLocked(el *list.Element) {
+	ie := el.Value.(*indexEntry)
+	c.chargeLocked(ie, -1)
+	c.index.lru.Remove(el)
+	delete(c.index.entries, ie.name)
+	c.indexChangedLocked()
+}
+
+// chargeLocked adds the size of the entry to the total, or subtracts it when
+// sign is negative, the size of data shared by entries is counted once
+func (c *Cache) chargeLocked(ie *indexEntry, sign int) {
+	if ie.digest == "" {
+		c.index.total += int64(sign) * ie.size
+		return
+	}
+	n := c.index.blobs[ie.digest]
+	switch {
+	case sign > 0:
+		if n == 0 {
+			c.index.total += ie.size
+		}
+		c.index.blobs[ie.digest] = n + 1
+	case n <= 1:
+		c.index.total -= ie.size
+		delete(c.index.blobs, ie.digest)
+	default:
+		c.index.blobs[ie.digest] = n - 1
+	}
+}
+
+// selectEntries returns the names of entries matching the selector
+func (c *Cache) selectEntries(what PurgeSelector, now time.Time) ([]string, error) {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if err := c.loadIndexLocked(); err != nil {
+		return nil, err
+	}
+	var selected []string
+	for name, el := range c.index.entries {
+		if what.selects(el.Value.(*indexEntry), now) {
+			selected = append(selected, name)
+		}
+	}
+	sort.Strings(selected)
+	return selected, nil
+}
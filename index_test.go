@@ -0,0 +1,190 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getEntry(t *testing.T, c *Cache, name string) {
+	r, _, err := c.Get(name)
+	require.NoError(t, err)
+	r.Close()
+}
+
+func indexEntryOf(t *testing.T, c *Cache, name string) indexEntry {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+	el, ok := c.index.entries[name]
+	require.True(t, ok, "entry %v not in index", name)
+	return *el.Value.(*indexEntry)
+}
+
+func TestCacheIndexSaveRestore(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-index-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	// an entry that was obtained long ago
+	makeFile(t, filepath.Join(td, "old"), []byte("old"))
+	mtime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(filepath.Join(td, "old"), mtime, mtime))
+
+	c := Cache{Dir: td}
+
+	putEntry(t, &c, "foo", "foo")
+	putEntry(t, &c, "bar/baz", "bazz")
+	getEntry(t, &c, "foo")
+	getEntry(t, &c, "/foo")
+	getEntry(t, &c, "bar/baz")
+
+	foo := indexEntryOf(t, &c, "foo")
+	assert.WithinDuration(t, time.Now(), foo.lastUsed, time.Minute)
+	assert.Equal(t, 2, foo.hits)
+	assert.True(t, c.index.saveScheduled)
+	old := indexEntryOf(t, &c, "old")
+	assert.Equal(t, 0, old.hits)
+	assert.True(t, old.lastUsed.Equal(mtime))
+	assert.True(t, old.modTime.Equal(mtime))
+
+	err = c.saveIndex()
+	require.NoError(t, err)
+	assert.False(t, c.index.saveScheduled)
+
+	// changes made behind the back of the cache
+	require.NoError(t, os.Remove(filepath.Join(td, "old")))
+	makeFile(t, filepath.Join(td, "new"), []byte("new"))
+
+	// the index is restored by a new instance
+	c2 := Cache{Dir: td}
+	count, err := c2.Count()
+	require.NoError(t, err)
+	assert.Equal(t, CacheCount{Items: 3, TotalSize: 10}, count)
+	assert.True(t, c2.index.restored)
+	foo2 := indexEntryOf(t, &c2, "foo")
+	assert.True(t, foo.lastUsed.Equal(foo2.lastUsed))
+	assert.Equal(t, 2, foo2.hits)
+	assert.Equal(t, 1, indexEntryOf(t, &c2, "bar/baz").hits)
+
+	err = c2.Reindex()
+	require.NoError(t, err)
+	count, err = c2.Count()
+	require.NoError(t, err)
+	assert.Equal(t, CacheCount{Items: 3, TotalSize: 10}, count)
+	c2.indexLock.Lock()
+	assert.Contains(t, c2.index.entries, "new")
+	assert.NotContains(t, c2.index.entries, "old")
+	c2.indexLock.Unlock()
+	// the use of entries is kept
+	assert.Equal(t, 2, indexEntryOf(t, &c2, "foo").hits)
+}
+
+func TestCacheLoadIndex(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-index-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	makeFile(t, filepath.Join(td, "foo"), []byte("foo"))
+
+	c := Cache{Dir: td}
+	require.NoError(t, c.LoadIndex())
+	assert.False(t, c.index.restored)
+	require.NoError(t, c.saveIndex())
+
+	makeFile(t, filepath.Join(td, "bar"), []byte("bar"))
+
+	c2 := Cache{Dir: td}
+	require.NoError(t, c2.LoadIndex())
+	assert.True(t, c2.index.restored)
+	// the index is updated in the background
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		count, err := c2.Count()
+		require.NoError(t, err)
+		if count.Items == 2 {
+			return
+		}
+	}
+	t.Fatalf("index not updated")
+}
+
+func TestCacheIndexEntryGone(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-index-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	putEntry(t, &c, "foo", "foo")
+	require.NoError(t, os.Remove(filepath.Join(td, "foo")))
+
+	_, _, err = c.Get("foo")
+	assert.True(t, os.IsNotExist(err))
+	count, err := c.Count()
+	require.NoError(t, err)
+	assert.Equal(t, CacheCount{}, count)
+}
+
+func TestCachePurgeNotAccessed(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-index-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	now := time.Now()
+	longAgo := now.Add(-10 * 24 * time.Hour)
+	for _, name := range []string{"popular", "idle", "rare"} {
+		fpath := filepath.Join(td, name)
+		makeFile(t, fpath, []byte(name))
+		// obtained long ago
+		require.NoError(t, os.Chtimes(fpath, longAgo, longAgo))
+	}
+
+	getEntry(t, &c, "popular")
+	getEntry(t, &c, "popular")
+	getEntry(t, &c, "rare")
+
+	// all entries are old, but some were accessed recently
+	removed, err := c.Purge(PurgeSelector{NotAccessedFor: 5 * 24 * time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), removed)
+	notExist(t, filepath.Join(td, "idle"))
+
+	// entries that were hit often enough are kept
+	removed, err = c.Purge(PurgeSelector{MinHits: 2})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), removed)
+	notExist(t, filepath.Join(td, "rare"))
+	assert.FileExists(t, filepath.Join(td, "popular"))
+
+	// all criteria must be met
+	removed, err = c.Purge(PurgeSelector{OlderThan: 5 * 24 * time.Hour, NotAccessedFor: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), removed)
+}
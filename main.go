@@ -22,6 +22,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -33,11 +34,11 @@ import (
 	"time"
 
 	"github.com/bboozzoo/viadown/assets"
+	"github.com/pkg/errors"
 )
 
 var (
 	optDebug         = flag.Bool("debug", false, "Enable debug logging")
-	optCacheRoot     = flag.String("cache-root", "./tmp", "Cache directory path")
 	optListenAddr    = flag.String("listen", ":8080", "Listen address")
 	optMirrors       = flag.String("mirrors", "", "Mirror list file")
 	optTimeout       = flag.Duration("client-timeout", 15*time.Second, "Forward request timeout")
@@ -45,20 +46,61 @@ var (
 	optSyslog        = flag.Bool("syslog", false, "Enable logging to syslog")
 	optPidfile       = flag.String("pidfile", "", "Write self PID to this file")
 	optPurgeInterval = flag.Duration("purge-interval", defaultCachePurgeInterval, "Cache purge interval")
+	optMaxOrphans    = flag.Int("max-orphaned-downloads", 10, "Maximum number of downloads continuing without clients (0 for no limit)")
+	optOrphanTimeout = flag.Duration("orphaned-download-timeout", 30*time.Minute, "Abort downloads continuing without clients after this time (0 for no timeout)")
+	optCacheRoots    StorageRoots
+	optMaxSize       ByteSize
+	optHotSize       = ByteSize(32 << 20)
+	optHotEntrySize  = ByteSize(4 << 20)
+	optHotMinHits    = flag.Int("hot-cache-min-hits", 2, "Number of hits of an entry before it is kept in memory")
+	optOffline       = flag.Bool("offline", false, "Serve from cache only, never contact upstream")
+	optFreshness     = flag.String("freshness-rules", "", "Freshness rules file (built-in rules are used if not set)")
+	optS3Endpoint    = flag.String("s3-endpoint", "", "URL of S3 compatible object store to keep the cache in, credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	optS3Bucket      = flag.String("s3-bucket", "viadown", "Object store bucket")
+	optS3Prefix      = flag.String("s3-prefix", "", "Prefix of object names in the bucket")
+	optS3Region      = flag.String("s3-region", s3DefaultRegion, "Object store region")
+	optShutdown      = flag.Duration("shutdown-timeout", 30*time.Second, "Time given to clients and downloads in progress to finish when shutting down")
+	optMaxConns      = flag.Int("upstream-max-conns-per-host", 0, "Maximum number of connections to a mirror (0 for no limit)")
+	optMaxIdleConns  = flag.Int("upstream-max-idle-conns-per-host", 8, "Maximum number of idle connections to a mirror kept alive")
+	optIdleTimeout   = flag.Duration("upstream-idle-conn-timeout", 90*time.Second, "Close idle connections to mirrors after this time (0 for no timeout)")
+	optReadTimeout   = flag.Duration("upstream-read-timeout", time.Minute, "Switch to another mirror when no data is received for this time (0 for no timeout)")
+	optMinThroughput ByteSize
+	optThroughputWin = flag.Duration("upstream-throughput-window", 30*time.Second, "Time over which the throughput of a transfer is averaged")
+	optMirrorFails   = flag.Int("mirror-max-failures", 3, "Skip a mirror after this many consecutive failures (0 to never skip)")
+	optMirrorBackoff = flag.Duration("mirror-backoff", time.Minute, "Time for which a failing mirror is skipped, doubled with every failed retry")
+	optMirrorMaxWait = flag.Duration("mirror-max-backoff", 30*time.Minute, "Maximum time for which a failing mirror is skipped (0 for no limit)")
+	optProbePath     = flag.String("probe-path", "", "Path of a file published by every mirror, such as lastsync or dists/stable/Release, probed in the background (probes are disabled if not set)")
+	optProbeInterval = flag.Duration("probe-interval", 10*time.Minute, "Mirror probe interval")
+	optMaxSyncLag    = flag.Duration("max-sync-lag", 24*time.Hour, "Exclude mirrors synchronized this much earlier than the freshest one (0 for no limit)")
+	optPartialMaxAge = flag.Duration("partial-max-age", 7*24*time.Hour, "Remove data of interrupted downloads not resumed for this time when purging (0 to keep until resumed)")
+	optVerifyHits    = flag.Float64("verify-hits", 0, "Share of cache hits, between 0 and 1, verified against the recorded digest")
 
 	Version = "(unknown)"
 
 	// try purging every 24h
 	defaultCachePurgeInterval = 24 * time.Hour
 	defaultPurgePolicy        = PurgeSelector{
-		// older than 30 days
-		OlderThan: 30 * 24 * time.Hour,
+		// not accessed for 30 days
+		NotAccessedFor: 30 * 24 * time.Hour,
 	}
 )
 
-func main() {
+func init() {
+	flag.Var(&optCacheRoots, "cache-root", "Cache directory `path`, optionally followed by :capacity, can be given more than once to spread the cache across directories (default \"./tmp\")")
+	flag.Var(&optMaxSize, "cache-max-size", "Maximum `size` of the cache, with optional K, M, G or T suffix (0 for no limit)")
+	flag.Var(&optHotSize, "hot-cache-size", "Maximum `size` of the entries kept in memory (0 to disable)")
+	flag.Var(&optHotEntrySize, "hot-cache-max-entry-size", "Maximum `size` of a single entry kept in memory")
+	flag.Var(&optMinThroughput, "upstream-min-throughput", "Minimum `size` of data received per second, with optional K, M, G or T suffix, below which another mirror is tried (0 for no limit)")
+}
 
-	flag.Parse()
+func main() {
+	// fsck verifies the cache instead of serving it
+	args := os.Args[1:]
+	fsck := len(args) > 0 && args[0] == "fsck"
+	if fsck {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	if *optVersion {
 		fmt.Println(Version)
@@ -73,6 +115,10 @@ func main() {
 		EnableDebugLog()
 	}
 
+	if fsck {
+		os.Exit(runFsck())
+	}
+
 	if *optMirrors == "" {
 		log.Errorf("no mirrors, cannot continue")
 		os.Exit(1)
@@ -97,12 +143,32 @@ func main() {
 		os.Exit(1)
 	}
 
-	log.Infof("cache root: %v", *optCacheRoot)
-	cache := Cache{
-		Dir: *optCacheRoot,
+	freshness := DefaultFreshnessPolicy
+	if *optFreshness != "" {
+		freshness, err = LoadFreshnessPolicy(*optFreshness)
+		if err != nil {
+			log.Errorf("failed to load freshness rules from %v: %v",
+				*optFreshness, err)
+			os.Exit(1)
+		}
+	}
+
+	cache, err := newCache()
+	if err != nil {
+		log.Errorf("failed to set up cache: %v", err)
+		os.Exit(1)
+	}
+
+	if err := cache.RemoveTemporary(); err != nil {
+		log.Errorf("failed to remove temporary files: %v", err)
+	}
+
+	if err := cache.LoadIndex(); err != nil {
+		log.Errorf("failed to load cache index: %v", err)
+		os.Exit(1)
 	}
 
-	cleaner := NewAutomaticCacheCleaner(&cache, *optPurgeInterval, defaultPurgePolicy)
+	cleaner := NewAutomaticCacheCleaner(cache, *optPurgeInterval, defaultPurgePolicy)
 
 	staticVfs := assets.FS(false)
 	if assetsDir := os.Getenv("ASSETS_DIR"); assetsDir != "" {
@@ -110,14 +176,33 @@ func main() {
 		staticVfs = http.Dir(assetsDir)
 	}
 
+	vs := NewViaDownloadServer(m, cache, *optTimeout, staticVfs)
+	vs.Freshness = freshness
+	vs.Pool = UpstreamPool{
+		MaxConnsPerHost:     *optMaxConns,
+		MaxIdleConnsPerHost: *optMaxIdleConns,
+		IdleConnTimeout:     *optIdleTimeout,
+	}
+	vs.Limits = TransferLimits{
+		IdleTimeout:      *optReadTimeout,
+		MinThroughput:    int64(optMinThroughput),
+		ThroughputWindow: *optThroughputWin,
+	}
+	vs.Breaker = MirrorBreaker{
+		Failures:   *optMirrorFails,
+		Backoff:    *optMirrorBackoff,
+		MaxBackoff: *optMirrorMaxWait,
+	}
+	vs.SetOffline(*optOffline)
+
 	addr := *optListenAddr
 	server := http.Server{
 		Addr:    addr,
-		Handler: NewViaDownloadServer(m, &cache, *optTimeout, staticVfs),
+		Handler: vs,
 	}
 	log.Infof("listen on %v", addr)
 
-	listenerrchan := make(chan error)
+	listenerrchan := make(chan error, 1)
 	sigchan := make(chan os.Signal, 3)
 
 	// wait for SIGINT, SIGTERM, SIGQUIT
@@ -132,6 +217,13 @@ func main() {
 	cleaner.Go()
 	log.Infof("automatic cache purge every %v, starting now", *optPurgeInterval)
 
+	var prober *MirrorProber
+	if *optProbePath != "" {
+		prober = NewMirrorProber(vs, *optProbePath, *optProbeInterval, *optMaxSyncLag)
+		prober.Go()
+		log.Infof("probing mirrors for %v every %v", *optProbePath, *optProbeInterval)
+	}
+
 	select {
 	case fail := <-listenerrchan:
 		log.Fatalf("listen failed: %v", fail)
@@ -139,5 +231,103 @@ func main() {
 		log.Infof("exiting on signal... %s", sig)
 	}
 
+	shutdown(&server, vs, cleaner, prober)
+}
+
+// shutdown stops accepting new requests and gives the clients and downloads
+// in progress the grace period to finish, the state of the cache is saved
+func shutdown(server *http.Server, vs *ViaDownloadServer, cleaner *AutomaticCacheCleaner, prober *MirrorProber) {
+	log.Infof("shutting down, grace period %v", *optShutdown)
+	ctx, cancel := context.WithTimeout(context.Background(), *optShutdown)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("clients did not finish in time: %v", err)
+		server.Close()
+	}
 	cleaner.Kill()
+	if prober != nil {
+		prober.Kill()
+	}
+	if err := vs.StopFsck(ctx); err != nil {
+		log.Errorf("cache check did not stop in time: %v", err)
+	}
+	if err := vs.Cache.Close(ctx); err != nil {
+		log.Errorf("failed to save cache state: %v", err)
+	}
+	vs.CloseIdleConnections()
+	log.Infof("shutdown complete")
+}
+
+// newCache sets up the cache as configured by the command line
+func newCache() (*Cache, error) {
+	roots := optCacheRoots
+	if len(roots) == 0 {
+		roots = StorageRoots{{Dir: "./tmp"}}
+	}
+	log.Infof("cache roots: %v", roots)
+	cache := &Cache{
+		Dir:             roots[0].Dir,
+		MaxOrphans:      *optMaxOrphans,
+		OrphanTimeout:   *optOrphanTimeout,
+		MaxSize:         int64(optMaxSize),
+		HotMaxSize:      int64(optHotSize),
+		HotMaxEntrySize: int64(optHotEntrySize),
+		HotMinHits:      *optHotMinHits,
+		VerifyHits:      *optVerifyHits,
+		PartialMaxAge:   *optPartialMaxAge,
+	}
+	if len(roots) > 1 {
+		cache.Storage = NewMultiStorage(roots)
+	}
+	if cache.MaxSize == 0 {
+		cache.MaxSize = roots.Capacity()
+	}
+	if *optS3Endpoint != "" {
+		log.Infof("cache in object store %v, bucket %v", *optS3Endpoint, *optS3Bucket)
+		// the data is spooled in the cache root while being uploaded
+		if err := os.MkdirAll(cache.Dir, 0700); err != nil {
+			return nil, errors.Wrap(err, "cannot create cache root")
+		}
+		cache.Storage = &S3Storage{
+			Endpoint:  *optS3Endpoint,
+			Bucket:    *optS3Bucket,
+			Prefix:    *optS3Prefix,
+			Region:    *optS3Region,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SpoolDir:  cache.Dir,
+		}
+	}
+	return cache, nil
+}
+
+// runFsck verifies the entries of the cache and quarantines the corrupt ones,
+// returns the exit code
+func runFsck() int {
+	cache, err := newCache()
+	if err != nil {
+		log.Errorf("failed to set up cache: %v", err)
+		return 2
+	}
+	report, err := cache.Fsck(context.Background())
+	if err != nil {
+		log.Errorf("cache check failed: %v", err)
+		return 2
+	}
+	for _, ce := range report.Corrupt {
+		fmt.Printf("%v: %v\n", ce.Name, ce.Problem)
+	}
+	fmt.Printf("%v entries verified, %v without digest, %v corrupt\n",
+		report.Checked, report.Unverified, len(report.Corrupt))
+	if len(report.Corrupt) == 0 {
+		return 0
+	}
+	// the saved index is brought up to date with the removed entries
+	if err := cache.Reindex(); err != nil {
+		log.Errorf("failed to update cache index: %v", err)
+	} else if err := cache.saveIndex(); err != nil {
+		log.Errorf("failed to save cache index: %v", err)
+	}
+	return 1
 }
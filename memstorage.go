@@ -0,0 +1,312 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryStorage keeps the objects in memory, it is meant for tests and small
+// amounts of data
+type MemoryStorage struct {
+	lock    sync.Mutex
+	objects map[string]*memObject
+}
+
+// memObject is the data of an object, which is kept by its readers and
+// writers even after the object is replaced or deleted
+type memObject struct {
+	data    []byte
+	modTime time.Time
+	// number of names referring to the object
+	links int
+}
+
+func notExistError(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (s *MemoryStorage) Get(name string) (StorageReader, StorageInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, ok := s.objects[cleanName(name)]
+	if !ok {
+		return nil, StorageInfo{}, notExistError("open", name)
+	}
+	return &memReader{storage: s, obj: obj}, s.infoLocked(obj), nil
+}
+
+func (s *MemoryStorage) Stat(name string) (StorageInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, ok := s.objects[cleanName(name)]
+	if !ok {
+		return StorageInfo{}, notExistError("stat", name)
+	}
+	return s.infoLocked(obj), nil
+}
+
+func (s *MemoryStorage) infoLocked(obj *memObject) StorageInfo {
+	return StorageInfo{
+		Size:    int64(len(obj.data)),
+		ModTime: obj.modTime,
+		Links:   obj.links,
+	}
+}
+
+func (s *MemoryStorage) Put(name string) (StorageWriter, error) {
+	return &memWriter{
+		storage: s,
+		obj:     &memObject{modTime: time.Now()},
+	}, nil
+}
+
+func (s *MemoryStorage) Append(name string, offset int64) (StorageWriter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	name = cleanName(name)
+	obj, ok := s.objects[name]
+	if !ok {
+		obj = &memObject{}
+		s.putLocked(name, obj)
+	}
+	if offset <= int64(len(obj.data)) {
+		obj.data = obj.data[:offset]
+	} else {
+		obj.data = append(obj.data, make([]byte, offset-int64(len(obj.data)))...)
+	}
+	obj.modTime = time.Now()
+	return &memWriter{
+		storage: s,
+		obj:     obj,
+		name:    name,
+	}, nil
+}
+
+func (s *MemoryStorage) putLocked(name string, obj *memObject) {
+	if s.objects == nil {
+		s.objects = make(map[string]*memObject)
+	}
+	s.removeLocked(name)
+	s.objects[name] = obj
+	obj.links++
+}
+
+func (s *MemoryStorage) removeLocked(name string) {
+	if obj, ok := s.objects[name]; ok {
+		obj.links--
+		delete(s.objects, name)
+	}
+}
+
+func (s *MemoryStorage) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	name = cleanName(name)
+	if _, ok := s.objects[name]; !ok {
+		return notExistError("remove", name)
+	}
+	s.removeLocked(name)
+	return nil
+}
+
+// Link makes both names refer to the same object
+func (s *MemoryStorage) Link(from, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, ok := s.objects[cleanName(from)]
+	if !ok {
+		return notExistError("link", from)
+	}
+	obj.modTime = time.Now()
+	s.putLocked(cleanName(to), obj)
+	return nil
+}
+
+// Walk visits the objects in the order of their names, the storage has no
+// directories
+func (s *MemoryStorage) Walk(fn StorageWalkFunc) error {
+	s.lock.Lock()
+	names := make([]string, 0, len(s.objects))
+	infos := make(map[string]StorageInfo, len(s.objects))
+	for name, obj := range s.objects {
+		names = append(names, name)
+		infos[name] = s.infoLocked(obj)
+	}
+	s.lock.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fn(name, infos[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type memReader struct {
+	storage *MemoryStorage
+	obj     *memObject
+	offset  int64
+	closed  bool
+}
+
+func (r *memReader) ReadAt(p []byte, off int64) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	r.storage.lock.Lock()
+	defer r.storage.lock.Unlock()
+
+	if off >= int64(len(r.obj.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.obj.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *memReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *memReader) Seek(offset int64, whence int) (int64, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		r.storage.lock.Lock()
+		offset += int64(len(r.obj.data))
+		r.storage.lock.Unlock()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *memReader) Close() error {
+	if r.closed {
+		return os.ErrClosed
+	}
+	r.closed = true
+	return nil
+}
+
+type memWriter struct {
+	storage *MemoryStorage
+	obj     *memObject
+	// set for objects obtained with Append
+	name   string
+	closed bool
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	w.storage.lock.Lock()
+	defer w.storage.lock.Unlock()
+
+	w.obj.data = append(w.obj.data, p...)
+	w.obj.modTime = time.Now()
+	return len(p), nil
+}
+
+func (w *memWriter) Open() (StorageReader, error) {
+	return &memReader{storage: w.storage, obj: w.obj}, nil
+}
+
+func (w *memWriter) Commit(name string) error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+
+	w.storage.lock.Lock()
+	defer w.storage.lock.Unlock()
+
+	if w.name != "" {
+		if w.storage.objects[w.name] != w.obj {
+			return notExistError("rename", w.name)
+		}
+		w.storage.removeLocked(w.name)
+	}
+	w.storage.putLocked(cleanName(name), w.obj)
+	return nil
+}
+
+func (w *memWriter) Abort() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+
+	w.storage.lock.Lock()
+	defer w.storage.lock.Unlock()
+
+	if w.name != "" && w.storage.objects[w.name] == w.obj {
+		w.storage.removeLocked(w.name)
+	}
+	return nil
+}
+
+func (w *memWriter) Close() error {
+	if w.name == "" {
+		return w.Abort()
+	}
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	return nil
+}
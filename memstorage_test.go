@@ -0,0 +1,89 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, &MemoryStorage{})
+}
+
+func TestMemoryStorageNames(t *testing.T) {
+	s := &MemoryStorage{}
+
+	require.NoError(t, writeObject(s, "/foo//bar", []byte("bar")))
+	data, err := readObject(s, "foo/bar")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", string(data))
+	assert.Equal(t, []string{"foo/bar"}, walkNames(t, s))
+}
+
+func TestCacheMemoryStorage(t *testing.T) {
+	c := Cache{Storage: &MemoryStorage{}, MaxSize: 10}
+
+	putEntry(t, &c, "foo", "1234")
+	putEntry(t, &c, "bar/baz", "5678")
+
+	r, size, err := c.Get("/foo")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), size)
+	assert.Equal(t, "1234", readAll(t, r))
+	require.NoError(t, r.Close())
+
+	meta, err := c.GetMeta("foo")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), meta.ContentLength)
+
+	// the least recently used entry is evicted
+	putEntry(t, &c, "new", "abcd")
+	_, _, err = c.Get("bar/baz")
+	assert.True(t, os.IsNotExist(err))
+
+	// partial data is kept in the storage too
+	ct, err := c.PutPartial("partial", PartialInfo{ETag: `"1234"`}, 0)
+	require.NoError(t, err)
+	_, err = ct.WriteString("12")
+	require.NoError(t, err)
+	require.NoError(t, ct.Suspend())
+	info, err := c.GetPartial("partial")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), info.Size)
+
+	// internal state does not show up in the index
+	require.NoError(t, c.saveIndex())
+	require.NoError(t, c.Reindex())
+	count, err := c.Count()
+	require.NoError(t, err)
+	assert.Equal(t, CacheCount{Items: 2, TotalSize: 8}, count)
+
+	removed, err := c.Purge(PurgeSelector{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), removed)
+	_, err = c.GetMeta("foo")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,161 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const metaSuffix = ".json"
+
+// metaDir is a directory inside the state directory, where the metadata of
+// entries is kept
+const metaDir = "meta"
+
+// EntryMeta is the metadata of a cache entry, recorded when the entry gets
+// committed
+type EntryMeta struct {
+	// ContentType, ETag and LastModified are headers of the upstream
+	// response
+	ContentType  string `json:",omitempty"`
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+	// ContentLength is the size of the data
+	ContentLength int64
+	// Mirror is the upstream location the data was obtained from
+	Mirror string `json:",omitempty"`
+	// Fetched is the time when the data was obtained, or last confirmed to
+	// be up to date with upstream
+	Fetched time.Time
+	// Digest of the data in the form of <algorithm>:<hex-digest>
+	Digest string
+}
+
+// ModTime returns the modification time of the data as reported by upstream,
+// or the time it was obtained
+func (m *EntryMeta) ModTime() time.Time {
+	if t, err := http.ParseTime(m.LastModified); err == nil {
+		return t
+	}
+	return m.Fetched
+}
+
+func (c *Cache) getMetaName(name string) string {
+	return path.Join(cacheStateDir, metaDir, name) + metaSuffix
+}
+
+// GetMeta returns the metadata of given entry. The error satisfies
+// os.IsNotExist if there is none.
+func (c *Cache) GetMeta(name string) (*EntryMeta, error) {
+	if meta := c.hot.getMeta(name); meta != nil {
+		return meta, nil
+	}
+	hotSeq := c.hot.sequence()
+
+	meta, err := readMeta(c.storage(), c.getMetaName(name))
+	if err != nil {
+		return nil, err
+	}
+	c.hot.putMeta(name, meta, hotSeq)
+	return meta, nil
+}
+
+// Revalidated records that the entry was found to be unchanged at given
+// upstream location at given time. The validators are updated from the
+// upstream response headers.
+func (c *Cache) Revalidated(name, url string, header http.Header, when time.Time) error {
+	meta, err := c.GetMeta(name)
+	if err != nil {
+		return err
+	}
+	meta.Fetched = when
+	if url != meta.Mirror {
+		// entity tags are only meaningful for the location that
+		// assigned them
+		meta.Mirror = url
+		meta.ETag = ""
+	}
+	if etag := header.Get("ETag"); etag != "" {
+		meta.ETag = etag
+	}
+	if lm := header.Get("Last-Modified"); lm != "" {
+		meta.LastModified = lm
+	}
+	err = writeMeta(c.storage(), c.getMetaName(name), meta)
+	c.hot.invalidate(name)
+	return errors.Wrapf(err, "cannot update metadata of %v", name)
+}
+
+func (c *Cache) removeMeta(name string) error {
+	err := c.storage().Delete(c.getMetaName(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func readMeta(s Storage, name string) (*EntryMeta, error) {
+	data, err := readObject(s, name)
+	if err != nil {
+		return nil, err
+	}
+	var meta EntryMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, errors.Wrapf(err, "cannot decode metadata %v", name)
+	}
+	return &meta, nil
+}
+
+func writeMeta(s Storage, name string, meta *EntryMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeObject(s, name, data)
+}
+
+// prepareMeta returns a writer of the metadata that is prepared to be committed
+func prepareMeta(s Storage, name string, meta *EntryMeta) (StorageWriter, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.Put(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if err := prepareWriter(w); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
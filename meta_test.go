@@ -0,0 +1,173 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheMeta(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-meta-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	_, err = c.GetMeta("foo/bar")
+	assert.True(t, os.IsNotExist(err))
+
+	ct, err := c.Put("foo/bar")
+	require.NoError(t, err)
+	ct.Meta = EntryMeta{
+		ContentType:  "application/foo",
+		ETag:         `"1234"`,
+		LastModified: "Wed, 21 Oct 2015 07:28:00 GMT",
+		Mirror:       "http://mirror/foo/bar",
+	}
+	_, err = ct.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = ct.WriteString("world")
+	require.NoError(t, err)
+	err = ct.Commit()
+	require.NoError(t, err)
+
+	meta, err := c.GetMeta("foo/bar")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), meta.Fetched, time.Minute)
+	meta.Fetched = time.Time{}
+	assert.Equal(t, &EntryMeta{
+		ContentType:   "application/foo",
+		ETag:          `"1234"`,
+		LastModified:  "Wed, 21 Oct 2015 07:28:00 GMT",
+		Mirror:        "http://mirror/foo/bar",
+		ContentLength: 11,
+		// echo -n 'hello world' | sha256sum
+		Digest: "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+	}, meta)
+	assert.Equal(t, time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC), meta.ModTime().UTC())
+
+	// metadata does not show up in the count
+	count, err := c.Count()
+	require.NoError(t, err)
+	assert.Equal(t, CacheCount{Items: 1, TotalSize: 11}, count)
+
+	// aborted objects leave the metadata untouched
+	ct, err = c.Put("foo/bar")
+	require.NoError(t, err)
+	ct.Meta.ContentType = "application/bar"
+	require.NoError(t, ct.Abort())
+	meta, err = c.GetMeta("foo/bar")
+	require.NoError(t, err)
+	assert.Equal(t, "application/foo", meta.ContentType)
+
+	// metadata is removed together with the entry
+	removed, err := c.Purge(PurgeSelector{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), removed)
+	_, err = c.GetMeta("foo/bar")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCacheMetaResumedDigest(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-meta-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	ct, err := c.PutPartial("foo", PartialInfo{ETag: `"1234"`}, 0)
+	require.NoError(t, err)
+	_, err = ct.Write([]byte("hello "))
+	require.NoError(t, err)
+	require.NoError(t, ct.Suspend())
+
+	ct, err = c.PutPartial("foo", PartialInfo{ETag: `"1234"`}, 6)
+	require.NoError(t, err)
+	_, err = ct.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, ct.Commit())
+
+	meta, err := c.GetMeta("foo")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), meta.ContentLength)
+	assert.Equal(t, "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", meta.Digest)
+}
+
+func TestCacheRevalidated(t *testing.T) {
+	c := Cache{Storage: &MemoryStorage{}}
+
+	ct, err := c.Put("core.db")
+	require.NoError(t, err)
+	ct.Meta = EntryMeta{
+		ETag:         `"a"`,
+		LastModified: "Wed, 21 Oct 2015 07:28:00 GMT",
+		Mirror:       "http://mirror-a/core.db",
+	}
+	_, err = ct.WriteString("core")
+	require.NoError(t, err)
+	require.NoError(t, ct.Commit())
+
+	// confirmed by the same mirror
+	when := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, c.Revalidated("core.db", "http://mirror-a/core.db", http.Header{}, when))
+	meta, err := c.GetMeta("core.db")
+	require.NoError(t, err)
+	assert.Equal(t, `"a"`, meta.ETag)
+	assert.Equal(t, "http://mirror-a/core.db", meta.Mirror)
+	assert.True(t, when.Equal(meta.Fetched))
+
+	// another mirror, the validators of the first one no longer apply
+	header := http.Header{}
+	header.Set("ETag", `"b"`)
+	require.NoError(t, c.Revalidated("core.db", "http://mirror-b/core.db", header, when))
+	meta, err = c.GetMeta("core.db")
+	require.NoError(t, err)
+	assert.Equal(t, `"b"`, meta.ETag)
+	assert.Equal(t, "http://mirror-b/core.db", meta.Mirror)
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", meta.LastModified)
+
+	// no entity tag from the other mirror
+	require.NoError(t, c.Revalidated("core.db", "http://mirror-a/core.db", http.Header{}, when))
+	meta, err = c.GetMeta("core.db")
+	require.NoError(t, err)
+	assert.Empty(t, meta.ETag)
+	assert.Equal(t, "http://mirror-a/core.db", meta.Mirror)
+}
+
+func TestEntryMetaModTime(t *testing.T) {
+	fetched := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	meta := EntryMeta{Fetched: fetched}
+	assert.Equal(t, fetched, meta.ModTime())
+
+	meta.LastModified = "garbage"
+	assert.Equal(t, fetched, meta.ModTime())
+
+	meta.LastModified = "Wed, 21 Oct 2015 07:28:00 GMT"
+	assert.Equal(t, time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC), meta.ModTime().UTC())
+}
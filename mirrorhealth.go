@@ -0,0 +1,354 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MirrorBreaker configures skipping of mirrors that keep failing
+type MirrorBreaker struct {
+	// Failures is the number of consecutive failures after which a mirror
+	// is skipped, 0 means that mirrors are never skipped
+	Failures int
+	// Backoff is the time for which a mirror is skipped at first, doubled
+	// with every failed retry, up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// backoff returns the time for which a mirror is skipped after given number of
+// consecutive failures
+func (b MirrorBreaker) backoff(failures int) time.Duration {
+	backoff := b.Backoff
+	for i := b.Failures; i < failures; i++ {
+		if b.MaxBackoff > 0 && backoff >= b.MaxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	if b.MaxBackoff > 0 && backoff > b.MaxBackoff {
+		backoff = b.MaxBackoff
+	}
+	return backoff
+}
+
+// MirrorStatus describes the health of a mirror, as observed by the requests
+// sent to it
+type MirrorStatus struct {
+	URL       string
+	Successes int
+	Failures  int
+	// ConsecutiveFailures is the number of failures since the last success
+	ConsecutiveFailures int
+	// Latency is the average time to response headers, in nanoseconds
+	Latency time.Duration
+	// Throughput is the average rate of data received, in bytes per second
+	Throughput  int64
+	LastError   string     `json:",omitempty"`
+	LastFailure *time.Time `json:",omitempty"`
+	// SkippedUntil is the time until which the mirror is not tried after
+	// repeated failures
+	SkippedUntil *time.Time `json:",omitempty"`
+	// LastProbe is the time of the last background probe, ProbeError is
+	// set if it failed
+	LastProbe  *time.Time `json:",omitempty"`
+	ProbeError string     `json:",omitempty"`
+	// LastSync is the time the mirror was last synchronized, as published
+	// by it
+	LastSync *time.Time `json:",omitempty"`
+	// Lag is how far the mirror is behind the freshest one, Lagging is set
+	// when it is too far behind to be used
+	Lag     time.Duration
+	Lagging bool
+}
+
+// scoreSize is the size of data used to rank mirrors, the time in which it is
+// expected to be received combines the latency and throughput
+const scoreSize = 1 << 20
+
+// minThroughputSample is the size of the smallest transfer used to measure the
+// throughput, the time of smaller ones is dominated by latency
+const minThroughputSample = 64 << 10
+
+func (s *MirrorStatus) score() time.Duration {
+	score := s.Latency
+	if s.Throughput > 0 {
+		score += time.Duration(scoreSize * int64(time.Second) / s.Throughput)
+	}
+	return score
+}
+
+func (s *MirrorStatus) skipped(now time.Time) bool {
+	return s.SkippedUntil != nil && now.Before(*s.SkippedUntil)
+}
+
+// average returns a moving average updated with a new sample
+func average(avg, sample int64) int64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg + (sample-avg)/4
+}
+
+// mirrorHealth tracks the health of mirrors
+type mirrorHealth struct {
+	lock    sync.Mutex
+	mirrors map[string]*MirrorStatus
+}
+
+func (h *mirrorHealth) stateLocked(mirror string) *MirrorStatus {
+	if h.mirrors == nil {
+		h.mirrors = make(map[string]*MirrorStatus)
+	}
+	s := h.mirrors[mirror]
+	if s == nil {
+		s = &MirrorStatus{URL: mirror}
+		h.mirrors[mirror] = s
+	}
+	return s
+}
+
+// succeeded records a successful request, with the latency and, if known, the
+// throughput of the transfer
+func (h *mirrorHealth) succeeded(mirror string, latency time.Duration, throughput int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := h.stateLocked(mirror)
+	s.Successes++
+	s.ConsecutiveFailures = 0
+	s.SkippedUntil = nil
+	if latency > 0 {
+		s.Latency = time.Duration(average(int64(s.Latency), int64(latency)))
+	}
+	if throughput > 0 {
+		s.Throughput = average(s.Throughput, throughput)
+	}
+}
+
+// failed records a failed request, the mirror is skipped once it failed too
+// many times in a row
+func (h *mirrorHealth) failed(mirror string, latency time.Duration, err error, breaker MirrorBreaker, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := h.stateLocked(mirror)
+	s.Failures++
+	s.ConsecutiveFailures++
+	s.LastError = err.Error()
+	s.LastFailure = &now
+	if latency > 0 {
+		s.Latency = time.Duration(average(int64(s.Latency), int64(latency)))
+	}
+	if breaker.Failures > 0 && s.ConsecutiveFailures >= breaker.Failures {
+		until := now.Add(breaker.backoff(s.ConsecutiveFailures))
+		log.Infof("skipping mirror %v until %v after %v failures", mirror,
+			until.Format(time.RFC3339), s.ConsecutiveFailures)
+		s.SkippedUntil = &until
+	}
+}
+
+// probed records the outcome of a background probe of a mirror, the time of
+// synchronization is zero if it is not known
+func (h *mirrorHealth) probed(mirror string, now, synced time.Time, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := h.stateLocked(mirror)
+	s.LastProbe = &now
+	s.ProbeError = ""
+	if err != nil {
+		s.ProbeError = err.Error()
+	}
+	if !synced.IsZero() {
+		s.LastSync = &synced
+	}
+}
+
+// checkLag finds the mirrors lagging more than maxLag behind the freshest one,
+// 0 means that none are
+func (h *mirrorHealth) checkLag(mirrors Mirrors, maxLag time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var freshest time.Time
+	for _, mirror := range mirrors {
+		if s := h.mirrors[mirror]; s != nil && s.LastSync != nil && s.LastSync.After(freshest) {
+			freshest = *s.LastSync
+		}
+	}
+	for _, mirror := range mirrors {
+		s := h.mirrors[mirror]
+		if s == nil || s.LastSync == nil {
+			continue
+		}
+		s.Lag = freshest.Sub(*s.LastSync)
+		lagging := maxLag > 0 && s.Lag > maxLag
+		if lagging && !s.Lagging {
+			log.Infof("excluding mirror %v, %v behind the freshest one", mirror, s.Lag)
+		}
+		s.Lagging = lagging
+	}
+}
+
+// order returns the mirrors that are not excluded, the healthy ones expected
+// to be the fastest first, and the ones that are excluded, either skipped
+// after failures or lagging behind
+func (h *mirrorHealth) order(mirrors Mirrors, now time.Time) (available, excluded Mirrors) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	scores := make(map[string]time.Duration, len(mirrors))
+	failing := make(map[string]bool, len(mirrors))
+	for _, mirror := range mirrors {
+		s := h.mirrors[mirror]
+		switch {
+		case s == nil:
+			// not tried yet
+			available = append(available, mirror)
+		case s.skipped(now), s.Lagging:
+			excluded = append(excluded, mirror)
+		default:
+			available = append(available, mirror)
+			scores[mirror] = s.score()
+			// mirrors retried after being skipped keep their rank
+			failing[mirror] = s.ConsecutiveFailures > 0 && s.SkippedUntil == nil
+		}
+	}
+	// healthy mirrors come first, the ones that were not measured keep the
+	// order of the list
+	sort.SliceStable(available, func(i, j int) bool {
+		a, b := available[i], available[j]
+		if failing[a] != failing[b] {
+			return !failing[a]
+		}
+		return scores[a] < scores[b]
+	})
+	return available, excluded
+}
+
+// status returns the status of given mirrors
+func (h *mirrorHealth) status(mirrors Mirrors) []MirrorStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	status := make([]MirrorStatus, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		if s := h.mirrors[mirror]; s != nil {
+			status = append(status, *s)
+		} else {
+			status = append(status, MirrorStatus{URL: mirror})
+		}
+	}
+	return status
+}
+
+// orderedMirrors returns the mirrors in the order in which they are tried, the
+// ones that are excluded are only tried if there is no other
+func (v *ViaDownloadServer) orderedMirrors() Mirrors {
+	available, excluded := v.health.order(v.Mirrors, time.Now())
+	if len(available) == 0 {
+		return excluded
+	}
+	return available
+}
+
+// MirrorStatus returns the status of all the mirrors, in the order in which
+// they are tried
+func (v *ViaDownloadServer) MirrorStatus() []MirrorStatus {
+	available, excluded := v.health.order(v.Mirrors, time.Now())
+	return v.health.status(append(available, excluded...))
+}
+
+// mirrorSample measures a request sent to a mirror
+type mirrorSample struct {
+	start   time.Time
+	written int64
+
+	lock      sync.Mutex
+	firstByte time.Time
+}
+
+// sampleMirror returns the context of a request to a mirror, in which the time
+// of the response is recorded
+func sampleMirror(ctx context.Context, d *Download) (context.Context, *mirrorSample) {
+	s := &mirrorSample{start: time.Now(), written: d.Written()}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			s.firstByte = time.Now()
+		},
+	}), s
+}
+
+// recordMirror updates the health of the mirror with the outcome of a request
+func (v *ViaDownloadServer) recordMirror(mirror string, s *mirrorSample, d *Download, err error) {
+	if d.Context().Err() != nil {
+		// aborted, no fault of the mirror
+		return
+	}
+	now := time.Now()
+	s.lock.Lock()
+	firstByte := s.firstByte
+	s.lock.Unlock()
+
+	var latency time.Duration
+	if !firstByte.IsZero() {
+		latency = firstByte.Sub(s.start)
+	}
+
+	var badStatusErr *errUpstreamBadStatus
+	var failedErr *errUpstreamFailed
+	var interruptedErr *errUpstreamInterrupted
+	switch {
+	case errors.As(err, &failedErr):
+		if latency == 0 {
+			// the time the mirror failed to respond in
+			latency = now.Sub(s.start)
+		}
+		v.health.failed(mirror, latency, err, v.Breaker, now)
+	case errors.As(err, &interruptedErr):
+		v.health.failed(mirror, latency, err, v.Breaker, now)
+	case errors.As(err, &badStatusErr):
+		if badStatusErr.Rsp.StatusCode >= http.StatusInternalServerError {
+			v.health.failed(mirror, latency, err, v.Breaker, now)
+		} else {
+			// missing files are expected
+			v.health.succeeded(mirror, latency, 0)
+		}
+	case err == nil, err == errEntryNotModified:
+		var throughput int64
+		size := d.Written() - s.written
+		if elapsed := now.Sub(firstByte); !firstByte.IsZero() && size >= minThroughputSample && elapsed > 0 {
+			throughput = size * int64(time.Second) / int64(elapsed)
+		}
+		v.health.succeeded(mirror, latency, throughput)
+	}
+}
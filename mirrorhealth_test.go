@@ -0,0 +1,170 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorBreakerBackoff(t *testing.T) {
+	b := MirrorBreaker{Failures: 3, Backoff: time.Minute, MaxBackoff: 5 * time.Minute}
+	assert.Equal(t, time.Minute, b.backoff(3))
+	assert.Equal(t, 2*time.Minute, b.backoff(4))
+	assert.Equal(t, 4*time.Minute, b.backoff(5))
+	assert.Equal(t, 5*time.Minute, b.backoff(6))
+	assert.Equal(t, 5*time.Minute, b.backoff(100))
+
+	// no limit
+	b.MaxBackoff = 0
+	assert.Equal(t, 8*time.Minute, b.backoff(6))
+}
+
+func TestMirrorHealthOrder(t *testing.T) {
+	var h mirrorHealth
+	mirrors := Mirrors{"a", "b", "c", "d"}
+	now := time.Now()
+
+	// nothing is known yet
+	available, skipped := h.order(mirrors, now)
+	assert.Equal(t, mirrors, available)
+	assert.Empty(t, skipped)
+
+	h.succeeded("a", 300*time.Millisecond, 0)
+	h.succeeded("b", 100*time.Millisecond, 0)
+	// faster transfers make up for the latency
+	h.succeeded("c", 200*time.Millisecond, 100<<20)
+	h.succeeded("c", 200*time.Millisecond, 100<<20)
+	available, _ = h.order(mirrors, now)
+	// mirrors that were not tried yet come first
+	assert.Equal(t, Mirrors{"d", "b", "c", "a"}, available)
+
+	breaker := MirrorBreaker{Failures: 2, Backoff: time.Minute}
+	h.failed("b", 0, errors.New("boom"), breaker, now)
+	available, skipped = h.order(mirrors, now)
+	// tried after the healthy ones
+	assert.Equal(t, Mirrors{"d", "c", "a", "b"}, available)
+	assert.Empty(t, skipped)
+
+	h.failed("b", 0, errors.New("bang"), breaker, now)
+	available, skipped = h.order(mirrors, now)
+	assert.Equal(t, Mirrors{"d", "c", "a"}, available)
+	assert.Equal(t, Mirrors{"b"}, skipped)
+
+	status := h.status(Mirrors{"b"})
+	require.Len(t, status, 1)
+	assert.Equal(t, 1, status[0].Successes)
+	assert.Equal(t, 2, status[0].Failures)
+	assert.Equal(t, 2, status[0].ConsecutiveFailures)
+	assert.Equal(t, "bang", status[0].LastError)
+	require.NotNil(t, status[0].SkippedUntil)
+	assert.Equal(t, now.Add(time.Minute), *status[0].SkippedUntil)
+
+	// retried at its rank once the time passes
+	available, skipped = h.order(mirrors, now.Add(time.Minute))
+	assert.Equal(t, Mirrors{"d", "b", "c", "a"}, available)
+	assert.Empty(t, skipped)
+
+	// and skipped for longer if it fails again
+	h.failed("b", 0, errors.New("bang"), breaker, now.Add(time.Minute))
+	_, skipped = h.order(mirrors, now.Add(2*time.Minute))
+	assert.Equal(t, Mirrors{"b"}, skipped)
+	_, skipped = h.order(mirrors, now.Add(3*time.Minute))
+	assert.Empty(t, skipped)
+
+	// a success resets the failures
+	h.succeeded("b", 100*time.Millisecond, 0)
+	status = h.status(Mirrors{"b"})
+	assert.Equal(t, 0, status[0].ConsecutiveFailures)
+	assert.Nil(t, status[0].SkippedUntil)
+}
+
+func TestViaMirrorSkipped(t *testing.T) {
+	var badRequests int
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badRequests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := newMockUpstreamServer(t, map[string]mockUpstreamResponse{
+		"/foo": {Body: "foo"},
+		"/bar": {Body: "bar"},
+		"/baz": {Body: "baz"},
+	})
+	defer good.Close()
+
+	fixture := setupVia(t, []string{bad.URL, good.URL})
+	defer fixture.Cleanup()
+	via := fixture.via
+	via.Breaker = MirrorBreaker{Failures: 1, Backoff: time.Hour}
+
+	for _, name := range []string{"foo", "bar", "baz"} {
+		body := assert.HTTPBody(via.ServeHTTP, http.MethodGet, "/"+name, nil)
+		assert.Equal(t, name, body)
+	}
+	// not tried after the failure
+	assert.Equal(t, 1, badRequests)
+
+	body := assert.HTTPBody(via.ServeHTTP, http.MethodGet, "/_viadown/mirrors", nil)
+	var status []MirrorStatus
+	require.NoError(t, json.Unmarshal([]byte(body), &status))
+	require.Len(t, status, 2)
+	assert.Equal(t, good.URL, status[0].URL)
+	assert.Equal(t, 3, status[0].Successes)
+	assert.Equal(t, 0, status[0].Failures)
+	assert.Nil(t, status[0].SkippedUntil)
+	assert.Equal(t, bad.URL, status[1].URL)
+	assert.Equal(t, 1, status[1].ConsecutiveFailures)
+	assert.Contains(t, status[1].LastError, "status 503")
+	assert.NotNil(t, status[1].SkippedUntil)
+}
+
+func TestViaMirrorAllSkipped(t *testing.T) {
+	var requests int
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	fixture := setupVia(t, []string{bad.URL})
+	defer fixture.Cleanup()
+	via := fixture.via
+	via.Breaker = MirrorBreaker{Failures: 1, Backoff: time.Hour}
+
+	// the only mirror is tried even though it is skipped
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/foo", nil)
+		require.NoError(t, err)
+		via.ServeHTTP(rec, req)
+		assert.NotEqual(t, http.StatusOK, rec.Code)
+	}
+	assert.Equal(t, 2, requests)
+}
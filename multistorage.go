@@ -0,0 +1,482 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// StorageRoot is a directory keeping a share of the cache
+type StorageRoot struct {
+	Dir string
+	// Capacity is the size of data the root is meant to hold, 0 if not
+	// limited
+	Capacity int64
+}
+
+// ParseStorageRoot parses a root given as path[:capacity], where capacity is
+// a size with optional K, M, G or T suffix
+func ParseStorageRoot(s string) (StorageRoot, error) {
+	if idx := strings.LastIndex(s, ":"); idx != -1 {
+		var capacity ByteSize
+		if err := capacity.Set(s[idx+1:]); err == nil {
+			s = s[:idx]
+			if s == "" {
+				return StorageRoot{}, errors.New("no directory")
+			}
+			return StorageRoot{Dir: s, Capacity: int64(capacity)}, nil
+		}
+	}
+	if s == "" {
+		return StorageRoot{}, errors.New("no directory")
+	}
+	return StorageRoot{Dir: s}, nil
+}
+
+// StorageRoots is a list of roots, which can be set from repeated command line
+// arguments
+type StorageRoots []StorageRoot
+
+func (r *StorageRoots) Set(s string) error {
+	root, err := ParseStorageRoot(s)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, root)
+	return nil
+}
+
+func (r StorageRoots) String() string {
+	var roots []string
+	for _, root := range r {
+		if root.Capacity != 0 {
+			roots = append(roots, root.Dir+":"+ByteSize(root.Capacity).String())
+		} else {
+			roots = append(roots, root.Dir)
+		}
+	}
+	return strings.Join(roots, ",")
+}
+
+// Capacity returns the total capacity of the roots, or 0 if any of them is
+// not limited
+func (r StorageRoots) Capacity() int64 {
+	var total int64
+	for _, root := range r {
+		if root.Capacity == 0 {
+			return 0
+		}
+		total += root.Capacity
+	}
+	return total
+}
+
+// RootStats describes the use of a storage root
+type RootStats struct {
+	Dir      string
+	Capacity int64
+	// Used is the size of objects known to be in the root
+	Used int64
+}
+
+type storageRoot struct {
+	StorageRoot
+	storage Storage
+	weight  float64
+	// protected by the lock of MultiStorage
+	used int64
+}
+
+// MultiStorage spreads the objects across several roots, such as directories
+// on different disks. The objects are placed by rendezvous hashing weighted by
+// the capacity of the roots, thus adding or losing a root only affects the
+// share of objects that belongs to it. Objects are looked up in all the roots,
+// in the order of preference, so they are found even if they were placed
+// differently before.
+type MultiStorage struct {
+	roots []*storageRoot
+	lock  sync.Mutex
+}
+
+// NewMultiStorage returns a storage spread across given roots. The roots
+// without capacity are weighted by the size of their file systems.
+func NewMultiStorage(roots []StorageRoot) *MultiStorage {
+	m := &MultiStorage{}
+	for _, root := range roots {
+		weight := float64(root.Capacity)
+		if weight == 0 {
+			weight = float64(fileSystemSize(root.Dir))
+		}
+		if weight == 0 {
+			weight = 1
+		}
+		m.roots = append(m.roots, &storageRoot{
+			StorageRoot: root,
+			storage:     &FileStorage{Dir: root.Dir},
+			weight:      weight,
+		})
+	}
+	return m
+}
+
+// fileSystemSize returns the size of the file system holding given directory,
+// or 0 if unknown
+func fileSystemSize(dir string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		log.Errorf("cannot obtain size of file system of %v: %v", dir, err)
+		return 0
+	}
+	return int64(st.Blocks) * int64(st.Bsize)
+}
+
+// entryOf returns the name of the cache entry given object belongs to, so that
+// the metadata and the partial data of an entry are kept along with its data
+func entryOf(name string) string {
+	name = cleanName(name)
+	metaPrefix := path.Join(cacheStateDir, metaDir) + "/"
+	partialPrefix := path.Join(cacheStateDir, partialDir) + "/"
+	switch {
+	case strings.HasPrefix(name, metaPrefix) && strings.HasSuffix(name, metaSuffix):
+		return strings.TrimSuffix(strings.TrimPrefix(name, metaPrefix), metaSuffix)
+	case strings.HasPrefix(name, partialPrefix):
+		entry := strings.TrimPrefix(name, partialPrefix)
+		for _, suffix := range []string{partialDataSuffix, partialInfoSuffix} {
+			if strings.HasSuffix(entry, suffix) {
+				return strings.TrimSuffix(entry, suffix)
+			}
+		}
+	}
+	return name
+}
+
+// order returns the roots in the order of preference for given object, the
+// objects of an entry share the order of its data
+func (m *MultiStorage) order(name string) []*storageRoot {
+	name = entryOf(name)
+	scores := make(map[*storageRoot]float64, len(m.roots))
+	for _, root := range m.roots {
+		h := fnv.New64a()
+		h.Write([]byte(root.Dir))
+		h.Write([]byte{0})
+		h.Write([]byte(name))
+		// uniformly distributed in (0, 1)
+		u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		scores[root] = -root.weight / math.Log(u)
+	}
+	ordered := make([]*storageRoot, len(m.roots))
+	copy(ordered, m.roots)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return scores[ordered[i]] > scores[ordered[j]]
+	})
+	return ordered
+}
+
+// mix64 spreads the bits of a hash, such that all of them depend on every bit
+// of the input (the finalizer of MurmurHash3)
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// find calls fn for the roots in the order of preference, until it succeeds.
+// Failures of roots are logged and the remaining ones are tried, the objects
+// kept in the roots that failed are considered lost.
+func (m *MultiStorage) find(name string, fn func(root *storageRoot) error) error {
+	for _, root := range m.order(name) {
+		err := fn(root)
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			log.Errorf("cannot access %v in %v: %v", name, root.Dir, err)
+		}
+	}
+	return notExistError("open", name)
+}
+
+func (m *MultiStorage) Get(name string) (r StorageReader, info StorageInfo, err error) {
+	err = m.find(name, func(root *storageRoot) error {
+		r, info, err = root.storage.Get(name)
+		return err
+	})
+	return r, info, err
+}
+
+func (m *MultiStorage) Stat(name string) (info StorageInfo, err error) {
+	err = m.find(name, func(root *storageRoot) error {
+		info, err = root.storage.Stat(name)
+		return err
+	})
+	return info, err
+}
+
+// place returns the roots in the order in which they are tried for a new
+// object, the roots that are full come last
+func (m *MultiStorage) place(name string) []*storageRoot {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var roots, full []*storageRoot
+	for _, root := range m.order(name) {
+		if root.Capacity != 0 && root.used >= root.Capacity {
+			full = append(full, root)
+		} else {
+			roots = append(roots, root)
+		}
+	}
+	return append(roots, full...)
+}
+
+func (m *MultiStorage) Put(name string) (StorageWriter, error) {
+	var w StorageWriter
+	var err error
+	for _, root := range m.place(name) {
+		w, err = root.storage.Put(name)
+		if err == nil {
+			return &multiWriter{StorageWriter: w, storage: m, root: root}, nil
+		}
+		log.Errorf("cannot write %v to %v: %v", name, root.Dir, err)
+	}
+	return nil, err
+}
+
+// Append continues with the object in the root where it exists, or places a
+// new one
+func (m *MultiStorage) Append(name string, offset int64) (StorageWriter, error) {
+	roots := m.place(name)
+	for _, root := range m.order(name) {
+		if _, err := root.storage.Stat(name); err == nil {
+			roots = []*storageRoot{root}
+			break
+		}
+	}
+	var w StorageWriter
+	var err error
+	for _, root := range roots {
+		w, err = root.storage.Append(name, offset)
+		if err == nil {
+			return &multiWriter{StorageWriter: w, storage: m, root: root, size: offset}, nil
+		}
+		log.Errorf("cannot write %v to %v: %v", name, root.Dir, err)
+	}
+	return nil, err
+}
+
+// Delete removes the object from all the roots, the roots that failed are
+// skipped
+func (m *MultiStorage) Delete(name string) error {
+	found := false
+	for _, root := range m.roots {
+		err := m.deleteFrom(root, name)
+		switch {
+		case err == nil:
+			found = true
+		case !os.IsNotExist(err):
+			log.Errorf("cannot remove %v from %v: %v", name, root.Dir, err)
+		}
+	}
+	if !found {
+		return notExistError("remove", name)
+	}
+	return nil
+}
+
+func (m *MultiStorage) deleteFrom(root *storageRoot, name string) error {
+	info, err := root.storage.Stat(name)
+	if err != nil {
+		return err
+	}
+	if err := root.storage.Delete(name); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	// the use is not known until the root is walked
+	if root.used -= info.Size; root.used < 0 {
+		root.used = 0
+	}
+	m.lock.Unlock()
+	return nil
+}
+
+// Link links the objects within the root that keeps the object named from, as
+// the data cannot be shared across roots. The copies of the object named to
+// kept in other roots are removed.
+func (m *MultiStorage) Link(from, to string) error {
+	return m.find(from, func(root *storageRoot) error {
+		l, ok := root.storage.(Linker)
+		if !ok {
+			return errors.Errorf("storage of %v cannot link objects", root.Dir)
+		}
+		if _, err := root.storage.Stat(from); err != nil {
+			return err
+		}
+		if err := l.Link(from, to); err != nil {
+			return err
+		}
+		for _, other := range m.roots {
+			if other == root {
+				continue
+			}
+			if err := m.deleteFrom(other, to); err != nil && !os.IsNotExist(err) {
+				log.Errorf("cannot remove old copy of %v from %v: %v", to, other.Dir, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Walk visits the objects of all the roots, objects present in more than one
+// root are visited once. The roots that cannot be walked are skipped. The use
+// of roots is updated with the objects that were visited.
+func (m *MultiStorage) Walk(fn StorageWalkFunc) error {
+	seen := make(map[string]bool)
+	for _, root := range m.roots {
+		var used int64
+		err := root.storage.Walk(func(name string, info StorageInfo) error {
+			if !info.IsDir {
+				used += info.Size
+				if seen[name] {
+					return nil
+				}
+				seen[name] = true
+			}
+			err := fn(name, info)
+			if err != nil && err != filepath.SkipDir {
+				return walkError{err}
+			}
+			return err
+		})
+		if werr, ok := err.(walkError); ok {
+			return werr.err
+		}
+		if err != nil {
+			log.Errorf("cannot walk %v: %v", root.Dir, err)
+			continue
+		}
+		m.lock.Lock()
+		root.used = used
+		m.lock.Unlock()
+	}
+	return nil
+}
+
+// RemoveTemporary removes the temporary objects of all the roots, the roots
+// that fail are skipped
+func (m *MultiStorage) RemoveTemporary() (count int, size int64, err error) {
+	for _, root := range m.roots {
+		r, ok := root.storage.(TemporaryRemover)
+		if !ok {
+			continue
+		}
+		rcount, rsize, rerr := r.RemoveTemporary()
+		count += rcount
+		size += rsize
+		if rerr != nil {
+			log.Errorf("cannot remove temporary objects of %v: %v", root.Dir, rerr)
+			err = rerr
+		}
+	}
+	return count, size, err
+}
+
+// RootStats returns the use of the roots
+func (m *MultiStorage) RootStats() []RootStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stats := make([]RootStats, 0, len(m.roots))
+	for _, root := range m.roots {
+		stats = append(stats, RootStats{
+			Dir:      root.Dir,
+			Capacity: root.Capacity,
+			Used:     root.used,
+		})
+	}
+	return stats
+}
+
+// multiWriter writes an object to one of the roots, and keeps track of its use
+type multiWriter struct {
+	StorageWriter
+	storage *MultiStorage
+	root    *storageRoot
+	size    int64
+}
+
+func (w *multiWriter) Write(p []byte) (int, error) {
+	n, err := w.StorageWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *multiWriter) Prepare() error {
+	return prepareWriter(w.StorageWriter)
+}
+
+// Commit replaces the object in all the roots
+func (w *multiWriter) Commit(name string) error {
+	var replaced int64
+	if info, err := w.root.storage.Stat(name); err == nil {
+		replaced = info.Size
+	}
+	if err := w.StorageWriter.Commit(name); err != nil {
+		return err
+	}
+	w.storage.lock.Lock()
+	w.root.used += w.size - replaced
+	w.storage.lock.Unlock()
+
+	for _, root := range w.storage.roots {
+		if root == w.root {
+			continue
+		}
+		if err := w.storage.deleteFrom(root, name); err != nil && !os.IsNotExist(err) {
+			log.Errorf("cannot remove old copy of %v from %v: %v", name, root.Dir, err)
+		}
+	}
+	return nil
+}
+
+// walkError carries an error returned by the walk function, as opposed to
+// the errors of walking a root
+type walkError struct {
+	err error
+}
+
+func (e walkError) Error() string {
+	return e.err.Error()
+}
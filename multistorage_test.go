@@ -0,0 +1,338 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStorageRoot(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		root StorageRoot
+		err  string
+	}{
+		{in: "/cache", root: StorageRoot{Dir: "/cache"}},
+		{in: "/cache:10G", root: StorageRoot{Dir: "/cache", Capacity: 10 << 30}},
+		{in: "/mnt/a:b", root: StorageRoot{Dir: "/mnt/a:b"}},
+		{in: "/mnt/a:b:500", root: StorageRoot{Dir: "/mnt/a:b", Capacity: 500}},
+		{in: ":10G", err: "no directory"},
+		{in: "", err: "no directory"},
+	} {
+		root, err := ParseStorageRoot(tc.in)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, "input %q", tc.in)
+		} else {
+			assert.NoError(t, err, "input %q", tc.in)
+			assert.Equal(t, tc.root, root, "input %q", tc.in)
+		}
+	}
+}
+
+func TestStorageRoots(t *testing.T) {
+	var roots StorageRoots
+	require.NoError(t, roots.Set("/a:1G"))
+	assert.Equal(t, int64(1<<30), roots.Capacity())
+	require.NoError(t, roots.Set("/b"))
+	assert.Equal(t, int64(0), roots.Capacity())
+	assert.Error(t, roots.Set(""))
+	assert.Equal(t, "/a:1G,/b", roots.String())
+}
+
+func makeRoots(t *testing.T, count int) (roots []StorageRoot, cleanup func()) {
+	td, err := ioutil.TempDir("", "viadown-multi-test-")
+	require.NoError(t, err)
+	for i := 0; i < count; i++ {
+		dir := filepath.Join(td, fmt.Sprintf("disk%v", i))
+		require.NoError(t, os.Mkdir(dir, 0755))
+		roots = append(roots, StorageRoot{Dir: dir, Capacity: 1 << 30})
+	}
+	return roots, func() { os.RemoveAll(td) }
+}
+
+func TestMultiStorage(t *testing.T) {
+	roots, cleanup := makeRoots(t, 3)
+	defer cleanup()
+
+	testStorage(t, NewMultiStorage(roots))
+}
+
+// rootOf returns the index of the root keeping given object
+func rootOf(t *testing.T, roots []StorageRoot, name string) int {
+	found := -1
+	for i, root := range roots {
+		if _, err := os.Stat(filepath.Join(root.Dir, name)); err == nil {
+			require.Equal(t, -1, found, "object %v in more than one root", name)
+			found = i
+		}
+	}
+	return found
+}
+
+func TestMultiStoragePlacement(t *testing.T) {
+	roots, cleanup := makeRoots(t, 4)
+	defer cleanup()
+
+	m := NewMultiStorage(roots[:3])
+	const count = 300
+	perRoot := make(map[int]int)
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("pkg-%v", i)
+		require.NoError(t, writeObject(m, name, []byte(name)))
+		perRoot[rootOf(t, roots, name)]++
+	}
+	// all roots get their share
+	for i := 0; i < 3; i++ {
+		assert.True(t, perRoot[i] > count/6, "root %v got %v objects", i, perRoot[i])
+	}
+
+	// adding a root only moves the objects that now belong to it
+	m = NewMultiStorage(roots)
+	require.NoError(t, m.Walk(func(name string, info StorageInfo) error { return nil }))
+	moved := 0
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("pkg-%v", i)
+		before := rootOf(t, roots, name)
+		// objects are found where they were placed
+		data, err := readObject(m, name)
+		require.NoError(t, err)
+		assert.Equal(t, name, string(data))
+
+		// replacing an object places it anew
+		require.NoError(t, writeObject(m, name, []byte("new")))
+		after := rootOf(t, roots, name)
+		if after != before {
+			assert.Equal(t, 3, after)
+			moved++
+		}
+	}
+	assert.True(t, moved > count/8 && moved < count/2, "moved %v objects", moved)
+
+	// the use of roots is tracked
+	var used int64
+	for _, rs := range m.RootStats() {
+		used += rs.Used
+	}
+	assert.Equal(t, int64(3*count), used)
+}
+
+func TestMultiStorageCapacity(t *testing.T) {
+	roots, cleanup := makeRoots(t, 2)
+	defer cleanup()
+
+	roots[0].Capacity = 10
+	roots[1].Capacity = 1000
+	m := NewMultiStorage(roots)
+	require.NoError(t, m.Walk(func(name string, info StorageInfo) error { return nil }))
+
+	// the first root fills up quickly
+	for i := 0; i < 100; i++ {
+		require.NoError(t, writeObject(m, fmt.Sprintf("pkg-%v", i), []byte("12345")))
+	}
+	stats := m.RootStats()
+	assert.True(t, stats[0].Used <= 10+5, "root used %v", stats[0].Used)
+	assert.Equal(t, int64(500), stats[0].Used+stats[1].Used)
+}
+
+func TestMultiStorageLostRoot(t *testing.T) {
+	roots, cleanup := makeRoots(t, 3)
+	defer cleanup()
+
+	m := NewMultiStorage(roots)
+	const count = 60
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("pkg-%v", i)
+		require.NoError(t, writeObject(m, name, []byte(name)))
+	}
+	lost := make(map[string]bool)
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("pkg-%v", i)
+		if rootOf(t, roots, name) == 1 {
+			lost[name] = true
+		}
+	}
+	require.NotEmpty(t, lost)
+
+	// the disk is gone, leaving something that cannot be accessed
+	require.NoError(t, os.RemoveAll(roots[1].Dir))
+	require.NoError(t, ioutil.WriteFile(roots[1].Dir, nil, 0644))
+
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("pkg-%v", i)
+		_, _, err := m.Get(name)
+		if lost[name] {
+			assert.True(t, os.IsNotExist(err))
+			// lost objects are placed in the remaining roots
+			require.NoError(t, writeObject(m, name, []byte(name)))
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+	assert.Len(t, walkNames(t, m), count)
+	for name := range lost {
+		require.NoError(t, m.Delete(name))
+	}
+	assert.Len(t, walkNames(t, m), count-len(lost))
+}
+
+func TestMultiStorageWalk(t *testing.T) {
+	roots, cleanup := makeRoots(t, 2)
+	defer cleanup()
+
+	// left behind in both roots
+	makeFile(t, filepath.Join(roots[0].Dir, "foo"), []byte("foo"))
+	makeFile(t, filepath.Join(roots[1].Dir, "foo"), []byte("foo"))
+	makeFile(t, filepath.Join(roots[1].Dir, "skipped/bar"), []byte("bar"))
+
+	m := NewMultiStorage(roots)
+	var names []string
+	err := m.Walk(func(name string, info StorageInfo) error {
+		if info.IsDir {
+			return filepath.SkipDir
+		}
+		names = append(names, name)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, names)
+
+	// the copies in all the roots are removed
+	require.NoError(t, m.Delete("foo"))
+	assert.Equal(t, -1, rootOf(t, roots, "foo"))
+}
+
+func TestMultiStorageLink(t *testing.T) {
+	roots, cleanup := makeRoots(t, 2)
+	defer cleanup()
+
+	m := NewMultiStorage(roots)
+	// an old copy is left in the other root
+	makeFile(t, filepath.Join(roots[0].Dir, "bar"), []byte("old"))
+	makeFile(t, filepath.Join(roots[1].Dir, "foo"), []byte("foo"))
+
+	require.NoError(t, m.Link("foo", "bar"))
+	assert.Equal(t, 1, rootOf(t, roots, "bar"))
+	data, err := readObject(m, "bar")
+	require.NoError(t, err)
+	assert.Equal(t, "foo", string(data))
+	info, err := m.Stat("foo")
+	require.NoError(t, err)
+	assert.Equal(t, 2, info.Links)
+
+	err = m.Link("missing", "baz")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMultiStorageRemoveTemporary(t *testing.T) {
+	roots, cleanup := makeRoots(t, 2)
+	defer cleanup()
+
+	makeFile(t, filepath.Join(roots[0].Dir, "foo.part.1"), []byte("foo"))
+	makeFile(t, filepath.Join(roots[1].Dir, "bar/baz.part.2"), []byte("bazbaz"))
+	makeFile(t, filepath.Join(roots[1].Dir, "bar/baz"), []byte("baz"))
+
+	count, size, err := NewMultiStorage(roots).RemoveTemporary()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, int64(9), size)
+	assert.Equal(t, 1, rootOf(t, roots, "bar/baz"))
+	assert.Equal(t, -1, rootOf(t, roots, "foo.part.1"))
+}
+
+func TestCacheMultiStorageEntryRoot(t *testing.T) {
+	roots, cleanup := makeRoots(t, 3)
+	defer cleanup()
+
+	m := NewMultiStorage(roots)
+	c := Cache{Storage: m}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("pkg-%v", i)
+		want := m.order(name)[0].Dir
+		dataName, infoName := c.getPartialNames(name)
+
+		// the data is not shared with other entries
+		data := name + "-data"
+		header := http.Header{
+			"Content-Length": {strconv.Itoa(len(data))},
+			"Etag":           {`"1234"`},
+		}
+
+		d, _ := c.StartDownload(name)
+		require.NoError(t, d.Begin("http://mirror/"+name, header, 0))
+		_, err := d.Write([]byte(data[:3]))
+		require.NoError(t, err)
+		require.NoError(t, d.Finish(io.ErrUnexpectedEOF))
+		// the partial data is kept where the entry belongs
+		assert.Equal(t, want, roots[rootOf(t, roots, dataName)].Dir)
+		assert.Equal(t, want, roots[rootOf(t, roots, infoName)].Dir)
+
+		d, _ = c.StartDownload(name)
+		require.NoError(t, d.Begin("http://mirror/"+name, header, 3))
+		_, err = d.Write([]byte(data[3:]))
+		require.NoError(t, err)
+		require.NoError(t, d.Finish(nil))
+		// and so is the data and metadata of the entry
+		assert.Equal(t, want, roots[rootOf(t, roots, name)].Dir)
+		assert.Equal(t, want, roots[rootOf(t, roots, c.getMetaName(name))].Dir)
+		assert.Equal(t, -1, rootOf(t, roots, dataName))
+	}
+}
+
+func TestCacheMultiStorage(t *testing.T) {
+	roots, cleanup := makeRoots(t, 3)
+	defer cleanup()
+
+	c := Cache{Storage: NewMultiStorage(roots)}
+	for i := 0; i < 10; i++ {
+		putEntry(t, &c, fmt.Sprintf("pkg-%v", i), fmt.Sprintf("pkg%v", i))
+	}
+	count, err := c.Count()
+	require.NoError(t, err)
+	assert.Equal(t, CacheCount{Items: 10, TotalSize: 40}, count)
+
+	stats := c.Stats()
+	require.Len(t, stats.Roots, 3)
+	var used int64
+	for i, rs := range stats.Roots {
+		assert.Equal(t, roots[i].Dir, rs.Dir)
+		used += rs.Used
+	}
+	// the metadata is kept in the roots too
+	assert.True(t, used > 40)
+
+	removed, err := c.Purge(PurgeSelector{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), removed)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, -1, rootOf(t, roots, fmt.Sprintf("pkg-%v", i)))
+	}
+}
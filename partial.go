@@ -0,0 +1,255 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	partialDataSuffix = ".part"
+	partialInfoSuffix = ".resume"
+)
+
+// PartialInfo describes the data of an interrupted download that is kept in
+// the cache, so that the download can be resumed later
+type PartialInfo struct {
+	// URL is the upstream location the data was obtained from
+	URL string
+	// ETag and LastModified are the validators of the upstream data
+	ETag         string
+	LastModified string
+	// Size is the number of bytes written so far
+	Size int64
+}
+
+// Resumable returns true if there is enough information to resume the
+// download
+func (p *PartialInfo) Resumable() bool {
+	return p.Size > 0 && (p.ETag != "" || p.LastModified != "")
+}
+
+// validatorFor returns a validator of the partial data that can be used in a
+// conditional request to given URL, or an empty string if there is none
+func (p *PartialInfo) validatorFor(url string) string {
+	// entity tags are assigned by the server, thus are only meaningful for
+	// the same location, weak ones cannot be used for range requests
+	if p.ETag != "" && p.URL == url && !strings.HasPrefix(p.ETag, "W/") {
+		return p.ETag
+	}
+	return p.LastModified
+}
+
+// partialDir is a directory inside the state directory, where the data of
+// interrupted downloads is kept
+const partialDir = "partial"
+
+func (c *Cache) getPartialNames(name string) (data, info string) {
+	pname := path.Join(cacheStateDir, partialDir, name)
+	return pname + partialDataSuffix, pname + partialInfoSuffix
+}
+
+// GetPartial returns the information about partial data of given entry. The
+// error satisfies os.IsNotExist if there is none.
+func (c *Cache) GetPartial(name string) (*PartialInfo, error) {
+	dataName, infoName := c.getPartialNames(name)
+
+	data, err := readObject(c.storage(), infoName)
+	if err != nil {
+		return nil, err
+	}
+	var info PartialInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, errors.Wrapf(err, "cannot decode partial data info of %v", name)
+	}
+
+	// the process may have been killed before the info got updated, the
+	// actual size of data is what counts
+	fi, err := c.storage().Stat(dataName)
+	if err != nil {
+		return nil, err
+	}
+	info.Size = fi.Size
+	return &info, nil
+}
+
+// DropPartial removes the partial data of given entry
+func (c *Cache) DropPartial(name string) error {
+	dataName, infoName := c.getPartialNames(name)
+	log.Debugf("dropping partial data %v", dataName)
+	if err := c.storage().Delete(dataName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := c.storage().Delete(infoName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// expirePartials removes the partial data of downloads that were not resumed
+// for longer than PartialMaxAge, returns the number of downloads removed
+func (c *Cache) expirePartials(now time.Time) int {
+	if c.PartialMaxAge == 0 {
+		return 0
+	}
+	prefix := path.Join(cacheStateDir, partialDir)
+	// the time of last change of either of the files of a download
+	changed := make(map[string]time.Time)
+	err := c.storage().Walk(func(name string, info StorageInfo) error {
+		if info.IsDir {
+			// only the directories leading to partial data are visited
+			if name == prefix || strings.HasPrefix(name, prefix+"/") ||
+				strings.HasPrefix(prefix, name+"/") {
+				return nil
+			}
+			return filepath.SkipDir
+		}
+		if !strings.HasPrefix(name, prefix+"/") {
+			return nil
+		}
+		entry := strings.TrimPrefix(name, prefix+"/")
+		switch {
+		case strings.HasSuffix(entry, partialDataSuffix):
+			entry = strings.TrimSuffix(entry, partialDataSuffix)
+		case strings.HasSuffix(entry, partialInfoSuffix):
+			entry = strings.TrimSuffix(entry, partialInfoSuffix)
+		default:
+			return nil
+		}
+		if info.ModTime.After(changed[entry]) {
+			changed[entry] = info.ModTime
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("cannot expire partial data: %v", err)
+		return 0
+	}
+
+	// no download can start while its partial data is being removed
+	c.downloadsLock.Lock()
+	defer c.downloadsLock.Unlock()
+
+	active := make(map[string]bool, len(c.downloads))
+	for name := range c.downloads {
+		active[indexKey(name)] = true
+	}
+	removed := 0
+	for entry, modTime := range changed {
+		if active[entry] || now.Sub(modTime) < c.PartialMaxAge {
+			continue
+		}
+		log.Infof("removing partial data of %v, not resumed since %v", entry, modTime)
+		if err := c.DropPartial(entry); err != nil {
+			log.Errorf("cannot remove partial data of %v: %v", entry, err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+// PutPartial prepares a temporary object for the data of given entry that can
+// be suspended and resumed later. When offset is non 0, the partial data of
+// the entry is kept up to offset and the new data is appended to it.
+func (c *Cache) PutPartial(name string, info PartialInfo, offset int64) (*CacheTemporaryObject, error) {
+	dataName, infoName := c.getPartialNames(name)
+
+	w, err := c.storage().Append(dataName, offset)
+	if err != nil {
+		log.Errorf("cache put partial for %v error: %v", dataName, err)
+		return nil, err
+	}
+
+	ct := CacheTemporaryObject{
+		w:        w,
+		cache:    c,
+		name:     name,
+		metaName: c.getMetaName(name),
+		hash:     sha256.New(),
+		size:     offset,
+		infoName: infoName,
+		info:     info,
+	}
+	ct.info.Size = offset
+	if offset != 0 {
+		// the digest covers all of the data, the kept data is read
+		// back from the writer, which already has it at hand
+		if err := hashWritten(ct.hash, w, offset); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	// the info is saved right away, so that the data can be resumed even
+	// if the process does not get a chance to suspend it
+	if err := ct.saveInfo(ct.info); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &ct, nil
+}
+
+func hashWritten(h hash.Hash, w StorageWriter, size int64) error {
+	r, err := w.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.CopyN(h, r, size)
+	return err
+}
+
+func (ct *CacheTemporaryObject) saveInfo(info PartialInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return writeObject(ct.cache.storage(), ct.infoName, data)
+}
+
+// Suspend keeps the data written so far, so that it can be resumed later.
+// Only temporary objects obtained with PutPartial can be suspended.
+func (ct *CacheTemporaryObject) Suspend() error {
+	if ct.infoName == "" {
+		return errors.New("temporary object cannot be suspended")
+	}
+	log.Debugf("suspend entry %v", ct.name)
+	ct.aborted = true
+
+	if err := ct.w.Close(); err != nil {
+		return err
+	}
+	// the info may be read by the followers of the download
+	info := ct.info
+	info.Size = ct.size
+	return ct.saveInfo(info)
+}
@@ -0,0 +1,233 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachePartial(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-partial-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	_, err = c.GetPartial("foo/bar")
+	assert.True(t, os.IsNotExist(err))
+
+	info := PartialInfo{
+		URL:  "http://mirror/foo/bar",
+		ETag: `"1234"`,
+	}
+	ct, err := c.PutPartial("foo/bar", info, 0)
+	require.NoError(t, err)
+	_, err = ct.Write([]byte("hello "))
+	require.NoError(t, err)
+
+	// info is available even before the object is suspended
+	pi, err := c.GetPartial("foo/bar")
+	require.NoError(t, err)
+	assert.Equal(t, &PartialInfo{
+		URL:  "http://mirror/foo/bar",
+		ETag: `"1234"`,
+		Size: 6,
+	}, pi)
+
+	err = ct.Suspend()
+	require.NoError(t, err)
+
+	// not committed
+	_, err = os.Stat(filepath.Join(td, "foo/bar"))
+	assert.True(t, os.IsNotExist(err))
+
+	pi, err = c.GetPartial("foo/bar")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), pi.Size)
+	assert.True(t, pi.Resumable())
+
+	// partial data does not show up in the count
+	count, err := c.Count()
+	require.NoError(t, err)
+	assert.Equal(t, CacheCount{}, count)
+
+	// resume
+	ct, err = c.PutPartial("foo/bar", *pi, pi.Size)
+	require.NoError(t, err)
+	_, err = ct.Write([]byte("world"))
+	require.NoError(t, err)
+	err = ct.Commit()
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(td, "foo/bar"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello world"), data)
+
+	// partial data is gone now
+	_, err = c.GetPartial("foo/bar")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCachePartialRestart(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-partial-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	ct, err := c.PutPartial("foo", PartialInfo{LastModified: "yesterday"}, 0)
+	require.NoError(t, err)
+	_, err = ct.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, ct.Suspend())
+
+	// start over
+	ct, err = c.PutPartial("foo", PartialInfo{LastModified: "today"}, 0)
+	require.NoError(t, err)
+	_, err = ct.Write([]byte("bar"))
+	require.NoError(t, err)
+	require.NoError(t, ct.Suspend())
+
+	pi, err := c.GetPartial("foo")
+	require.NoError(t, err)
+	assert.Equal(t, &PartialInfo{LastModified: "today", Size: 3}, pi)
+
+	err = c.DropPartial("foo")
+	require.NoError(t, err)
+	_, err = c.GetPartial("foo")
+	assert.True(t, os.IsNotExist(err))
+	// dropping again is fine
+	err = c.DropPartial("foo")
+	assert.NoError(t, err)
+
+	// aborted objects are not kept
+	ct, err = c.PutPartial("foo", PartialInfo{LastModified: "today"}, 0)
+	require.NoError(t, err)
+	_, err = ct.Write([]byte("bar"))
+	require.NoError(t, err)
+	require.NoError(t, ct.Abort())
+	_, err = c.GetPartial("foo")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPartialInfoResumable(t *testing.T) {
+	assert.False(t, (&PartialInfo{}).Resumable())
+	assert.False(t, (&PartialInfo{Size: 10}).Resumable())
+	assert.False(t, (&PartialInfo{ETag: `"foo"`}).Resumable())
+	assert.True(t, (&PartialInfo{ETag: `"foo"`, Size: 10}).Resumable())
+	assert.True(t, (&PartialInfo{LastModified: "today", Size: 10}).Resumable())
+}
+
+func TestPartialInfoValidator(t *testing.T) {
+	pi := PartialInfo{URL: "http://foo/bar", ETag: `"1234"`, LastModified: "today"}
+	assert.Equal(t, `"1234"`, pi.validatorFor("http://foo/bar"))
+	// entity tags are only valid for the same location
+	assert.Equal(t, "today", pi.validatorFor("http://baz/bar"))
+
+	pi = PartialInfo{URL: "http://foo/bar", ETag: `W/"1234"`, LastModified: "today"}
+	assert.Equal(t, "today", pi.validatorFor("http://foo/bar"))
+
+	pi = PartialInfo{URL: "http://foo/bar", ETag: `"1234"`}
+	assert.Equal(t, "", pi.validatorFor("http://baz/bar"))
+}
+
+func TestCacheSuspendNotPartial(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-partial-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	ct, err := c.Put("foo")
+	require.NoError(t, err)
+	err = ct.Suspend()
+	assert.EqualError(t, err, "temporary object cannot be suspended")
+	ct.Abort()
+}
+
+func suspendPartial(t *testing.T, c *Cache, name, data string) {
+	ct, err := c.PutPartial(name, PartialInfo{ETag: `"1234"`}, 0)
+	require.NoError(t, err)
+	_, err = ct.WriteString(data)
+	require.NoError(t, err)
+	require.NoError(t, ct.Suspend())
+}
+
+func TestCacheExpirePartials(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-partial-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td, PartialMaxAge: 24 * time.Hour}
+
+	suspendPartial(t, &c, "old.iso", "abandoned")
+	suspendPartial(t, &c, "foo/recent.iso", "recent")
+	suspendPartial(t, &c, "active.iso", "in progress")
+	// info left behind without data
+	_, info := c.getPartialNames("orphan.iso")
+	makeFile(t, filepath.Join(td, info), []byte("{}"))
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"old.iso", "active.iso", "orphan.iso"} {
+		data, info := c.getPartialNames(name)
+		for _, fpath := range []string{data, info} {
+			err := os.Chtimes(filepath.Join(td, fpath), old, old)
+			if name == "orphan.iso" && fpath == data {
+				continue
+			}
+			require.NoError(t, err)
+		}
+	}
+	d, _ := c.StartDownload("/active.iso")
+
+	_, err = c.Purge(PurgeSelector{})
+	require.NoError(t, err)
+
+	for _, name := range []string{"old.iso", "orphan.iso"} {
+		data, info := c.getPartialNames(name)
+		for _, fpath := range []string{data, info} {
+			_, err := os.Stat(filepath.Join(td, fpath))
+			assert.True(t, os.IsNotExist(err), "%v not removed", fpath)
+		}
+	}
+	for _, name := range []string{"foo/recent.iso", "active.iso"} {
+		_, err := c.GetPartial(name)
+		assert.NoError(t, err, "partial data of %v removed", name)
+	}
+	d.Finish(errors.New("aborted"))
+
+	// kept until resumed
+	c.PartialMaxAge = 0
+	require.NoError(t, os.Chtimes(filepath.Join(td, cacheStateDir, partialDir, "active.iso.part"), old, old))
+	_, err = c.Purge(PurgeSelector{})
+	require.NoError(t, err)
+	_, err = c.GetPartial("active.iso")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,173 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// maxProbeSize is the size of the probe response that is looked at, the date
+// of Debian Release files is near the top
+const maxProbeSize = 64 << 10
+
+// MirrorProber periodically fetches a file published by every mirror to
+// check that it is reachable and find out when it was last synchronized
+type MirrorProber struct {
+	via      *ViaDownloadServer
+	path     string
+	interval time.Duration
+	maxLag   time.Duration
+	tmb      tomb.Tomb
+}
+
+// NewMirrorProber returns a prober of the file at given path of the mirrors,
+// mirrors lagging more than maxLag behind the freshest one are excluded, 0
+// means that none are
+func NewMirrorProber(via *ViaDownloadServer, path string, interval, maxLag time.Duration) *MirrorProber {
+	return &MirrorProber{
+		via:      via,
+		path:     path,
+		interval: interval,
+		maxLag:   maxLag,
+	}
+}
+
+func (p *MirrorProber) Go() {
+	p.tmb.Go(p.periodicProbe)
+}
+
+func (p *MirrorProber) periodicProbe() error {
+	intervalTimer := time.NewTimer(0)
+	defer intervalTimer.Stop()
+
+infiniteLoop:
+	for {
+		select {
+		case <-p.tmb.Dying():
+			break infiniteLoop
+		case <-intervalTimer.C:
+			p.probeAll()
+			intervalTimer.Reset(p.interval)
+		}
+	}
+	return nil
+}
+
+func (p *MirrorProber) Kill() error {
+	p.tmb.Kill(nil)
+	return p.tmb.Wait()
+}
+
+// probeAll probes every mirror and updates their health, only mirrors that
+// cannot be reached count as failing, the outcome of the requests for data is
+// what tells whether a mirror is usable
+func (p *MirrorProber) probeAll() {
+	for _, mirror := range p.via.Mirrors {
+		start := time.Now()
+		synced, err := p.probe(mirror)
+		if p.tmb.Err() != tomb.ErrStillAlive {
+			// stopped
+			return
+		}
+		var failedErr *errUpstreamFailed
+		switch {
+		case errors.As(err, &failedErr):
+			log.Errorf("mirror %v is unreachable: %v", mirror, err)
+			p.via.health.failed(mirror, time.Since(start), err, p.via.Breaker, time.Now())
+		case err != nil:
+			log.Errorf("probe of mirror %v failed: %v", mirror, err)
+		default:
+			log.Debugf("mirror %v last synchronized at %v", mirror, synced)
+		}
+		p.via.health.probed(mirror, time.Now(), synced, err)
+	}
+	p.via.health.checkLag(p.via.Mirrors, p.maxLag)
+}
+
+// probe fetches the probe file of a mirror and returns the time of its last
+// synchronization, the error is errUpstreamFailed if the mirror cannot be
+// reached
+func (p *MirrorProber) probe(mirror string) (time.Time, error) {
+	ctx := p.tmb.Context(nil)
+	if p.via.ClientTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 2*p.via.ClientTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest(http.MethodGet, buildURL(mirror, p.path), nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot prepare request: %w", err)
+	}
+	rsp, err := p.via.upstreamClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return time.Time{}, &errUpstreamFailed{err: err}
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("unexpected status %v", rsp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(rsp.Body, maxProbeSize))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot read response: %w", err)
+	}
+	return parseSyncTime(data, rsp.Header)
+}
+
+// parseSyncTime returns the time of the last synchronization of a mirror
+// found in the probe file, which is either ArchLinux lastsync holding a Unix
+// timestamp or Debian Release with a Date field, otherwise Last-Modified of
+// the response is used
+func parseSyncTime(data []byte, header http.Header) (time.Time, error) {
+	if ts, err := strconv.ParseInt(string(bytes.TrimSpace(data)), 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	scan := bufio.NewScanner(bytes.NewReader(data))
+	for scan.Scan() {
+		line := scan.Text()
+		if !strings.HasPrefix(line, "Date:") {
+			continue
+		}
+		value := strings.TrimSpace(strings.TrimPrefix(line, "Date:"))
+		for _, layout := range []string{time.RFC1123, time.RFC1123Z} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid date %q", value)
+	}
+	if lm := header.Get("Last-Modified"); lm != "" {
+		return http.ParseTime(lm)
+	}
+	return time.Time{}, errors.New("no synchronization time")
+}
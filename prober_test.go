@@ -0,0 +1,202 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSyncTime(t *testing.T) {
+	synced := time.Date(2026, 10, 10, 8, 16, 24, 0, time.UTC)
+
+	// ArchLinux lastsync
+	tm, err := parseSyncTime([]byte(fmt.Sprintf("%v\n", synced.Unix())), http.Header{})
+	require.NoError(t, err)
+	assert.True(t, synced.Equal(tm))
+
+	// Debian Release
+	release := `Origin: Debian
+Label: Debian
+Suite: stable
+Codename: trixie
+Date: Sat, 10 Oct 2026 08:16:24 UTC
+Acquire-By-Hash: yes
+`
+	tm, err = parseSyncTime([]byte(release), http.Header{})
+	require.NoError(t, err)
+	assert.True(t, synced.Equal(tm))
+
+	tm, err = parseSyncTime([]byte("Date: Sat, 10 Oct 2026 10:16:24 +0200\n"), http.Header{})
+	require.NoError(t, err)
+	assert.True(t, synced.Equal(tm))
+
+	_, err = parseSyncTime([]byte("Date: yesterday\n"), http.Header{})
+	assert.EqualError(t, err, `invalid date "yesterday"`)
+
+	// anything else
+	tm, err = parseSyncTime([]byte("hello"), http.Header{
+		"Last-Modified": []string{synced.Format(http.TimeFormat)},
+	})
+	require.NoError(t, err)
+	assert.True(t, synced.Equal(tm))
+
+	_, err = parseSyncTime([]byte("hello"), http.Header{})
+	assert.EqualError(t, err, "no synchronization time")
+}
+
+// newLastsyncServer returns a mirror publishing the time of synchronization,
+// which can be updated
+func newLastsyncServer(t *testing.T, synced time.Time) (*httptest.Server, *int64) {
+	ts := synced.Unix()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/lastsync", r.URL.Path)
+		fmt.Fprintf(w, "%v\n", atomic.LoadInt64(&ts))
+	}))
+	return srv, &ts
+}
+
+func TestMirrorProber(t *testing.T) {
+	now := time.Now()
+	fresh, _ := newLastsyncServer(t, now.Add(-time.Hour))
+	defer fresh.Close()
+	stale, staleSynced := newLastsyncServer(t, now.Add(-3*24*time.Hour))
+	defer stale.Close()
+	behind, _ := newLastsyncServer(t, now.Add(-12*time.Hour))
+	defer behind.Close()
+	broken := newMockUpstreamServer(t, map[string]mockUpstreamResponse{
+		"/lastsync": {Code: http.StatusInternalServerError},
+	})
+	defer broken.Close()
+
+	fixture := setupVia(t, []string{stale.URL, broken.URL, behind.URL, fresh.URL})
+	defer fixture.Cleanup()
+	via := fixture.via
+
+	prober := NewMirrorProber(via, "lastsync", time.Hour, 24*time.Hour)
+	prober.probeAll()
+
+	status := map[string]MirrorStatus{}
+	for _, s := range via.MirrorStatus() {
+		require.NotNil(t, s.LastProbe, "mirror %v not probed", s.URL)
+		status[s.URL] = s
+	}
+	require.Len(t, status, 4)
+
+	assert.False(t, status[fresh.URL].Lagging)
+	assert.Equal(t, time.Duration(0), status[fresh.URL].Lag)
+	require.NotNil(t, status[fresh.URL].LastSync)
+	assert.Equal(t, now.Add(-time.Hour).Unix(), status[fresh.URL].LastSync.Unix())
+	assert.False(t, status[behind.URL].Lagging)
+	assert.Equal(t, 11*time.Hour, status[behind.URL].Lag)
+	// too far behind
+	assert.True(t, status[stale.URL].Lagging)
+	assert.Equal(t, 71*time.Hour, status[stale.URL].Lag)
+	// reachable, but the probe failed, which does not count against
+	// the mirror
+	assert.Equal(t, "unexpected status 500", status[broken.URL].ProbeError)
+	assert.Equal(t, 0, status[broken.URL].Failures)
+	assert.Nil(t, status[broken.URL].LastSync)
+	assert.Contains(t, via.orderedMirrors(), broken.URL)
+
+	// the lagging mirror is tried only if there is no other
+	assert.NotContains(t, via.orderedMirrors(), stale.URL)
+	assert.Len(t, via.orderedMirrors(), 3)
+
+	// caught up
+	atomic.StoreInt64(staleSynced, now.Unix())
+	prober.probeAll()
+	assert.Contains(t, via.orderedMirrors(), stale.URL)
+	for _, s := range via.MirrorStatus() {
+		if s.URL == stale.URL {
+			assert.False(t, s.Lagging)
+		} else if s.URL == fresh.URL {
+			assert.True(t, s.Lag > 0)
+		}
+	}
+}
+
+func TestMirrorProberLoop(t *testing.T) {
+	probed := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v\n", time.Now().Unix())
+		probed <- struct{}{}
+	}))
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+
+	prober := NewMirrorProber(fixture.via, "lastsync", 10*time.Millisecond, 0)
+	prober.Go()
+	// probed right away, and then periodically
+	<-probed
+	<-probed
+	assert.NoError(t, prober.Kill())
+}
+
+func TestMirrorProberBreaker(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	skipped, _ := newLastsyncServer(t, time.Now())
+	defer skipped.Close()
+	garbage := newMockUpstreamServer(t, map[string]mockUpstreamResponse{
+		"/lastsync": {Body: "garbage"},
+	})
+	defer garbage.Close()
+
+	fixture := setupVia(t, []string{dead.URL, skipped.URL, garbage.URL})
+	defer fixture.Cleanup()
+	via := fixture.via
+	via.Breaker = MirrorBreaker{Failures: 1, Backoff: time.Hour}
+
+	// failing requests for data
+	via.health.failed(skipped.URL, 0, errors.New("boom"), via.Breaker, time.Now())
+
+	prober := NewMirrorProber(via, "lastsync", time.Hour, 0)
+	prober.probeAll()
+
+	status := map[string]MirrorStatus{}
+	for _, s := range via.MirrorStatus() {
+		status[s.URL] = s
+	}
+	// only the mirror that cannot be reached counts as failing
+	assert.Equal(t, 1, status[dead.URL].ConsecutiveFailures)
+	assert.NotNil(t, status[dead.URL].SkippedUntil)
+	assert.Contains(t, status[dead.URL].ProbeError, "upstream request failed")
+	assert.Equal(t, 0, status[garbage.URL].Failures)
+	assert.Equal(t, "no synchronization time", status[garbage.URL].ProbeError)
+	// a successful probe does not make up for failing requests
+	assert.Equal(t, 1, status[skipped.URL].ConsecutiveFailures)
+	assert.NotNil(t, status[skipped.URL].SkippedUntil)
+	assert.Empty(t, status[skipped.URL].ProbeError)
+
+	assert.Equal(t, Mirrors{garbage.URL}, via.orderedMirrors())
+}
@@ -0,0 +1,899 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	s3DefaultRegion   = "us-east-1"
+	s3DefaultPartSize = 16 << 20
+
+	// hash of the payload of requests with no body
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// the payload of requests carrying data is not signed, so that it
+	// does not need to be read twice
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3Storage keeps the objects in a bucket of an S3 compatible object store,
+// such as MinIO. The data being written is spooled to local temporary files,
+// so that it can be read back while it is being uploaded.
+type S3Storage struct {
+	// Endpoint is the URL of the object store, eg. http://minio:9000, the
+	// bucket is addressed by path
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to the names of objects
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// PartSize is the size of parts of multipart uploads, the objects
+	// that are not larger are uploaded in a single request
+	PartSize int64
+	// SpoolDir is where the data being written is kept, the system
+	// temporary directory is used if not set
+	SpoolDir string
+	// Client is used for the requests, http.DefaultClient is used if not
+	// set
+	Client *http.Client
+}
+
+// S3Error is an error response of the object store
+type S3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *S3Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("status %v %v", e.Status, e.Code)
+	}
+	return fmt.Sprintf("status %v %v: %v", e.Status, e.Code, e.Message)
+}
+
+type s3ErrorResponse struct {
+	XMLName xml.Name
+	Code    string
+	Message string
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CopyPartResult struct {
+	ETag string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+}
+
+func (s *S3Storage) region() string {
+	if s.Region == "" {
+		return s3DefaultRegion
+	}
+	return s.Region
+}
+
+func (s *S3Storage) partSize() int64 {
+	if s.PartSize <= 0 {
+		return s3DefaultPartSize
+	}
+	return s.PartSize
+}
+
+func (s *S3Storage) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+// key returns the key of the object of given name
+func (s *S3Storage) key(name string) string {
+	return path.Join(s.Prefix, cleanName(name))
+}
+
+// do sends a signed request for the object of given key, or for the bucket if
+// the key is empty. Responses with status other than 2xx are turned into
+// errors, an error satisfying os.IsNotExist is returned if the object does not
+// exist.
+func (s *S3Storage) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid endpoint")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = awsEscape(u.Path, true)
+	u.RawQuery = awsQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// the URL is kept as is, so that the path is sent exactly as signed
+	req.URL = u
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := s3EmptyPayloadHash
+	// a body of zero length would be sent in chunks
+	if body != nil && size > 0 {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+		payloadHash = s3UnsignedPayload
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, payloadHash, s.AccessKey, s.SecretKey, s.region(), "s3", time.Now())
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		target := key
+		if key == "" {
+			target = "bucket " + s.Bucket
+		}
+		return nil, s3ResponseError(resp, method, target)
+	}
+	return resp, nil
+}
+
+func s3ResponseError(resp *http.Response, method, target string) error {
+	var er s3ErrorResponse
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	xml.Unmarshal(data, &er)
+	// responses to HEAD requests have no body
+	if resp.StatusCode == http.StatusNotFound && (er.Code == "NoSuchKey" || er.Code == "" && method == http.MethodHead) {
+		return notExistError(strings.ToLower(method), target)
+	}
+	code := er.Code
+	if code == "" {
+		code = http.StatusText(resp.StatusCode)
+	}
+	return errors.Wrapf(&S3Error{
+		Status:  resp.StatusCode,
+		Code:    code,
+		Message: er.Message,
+	}, "cannot %v %v", strings.ToLower(method), target)
+}
+
+// decodeResponse decodes the XML body of a response, some of the requests
+// may fail even though the response status is 200
+func decodeResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var er s3ErrorResponse
+	if xml.Unmarshal(data, &er) == nil && er.XMLName.Local == "Error" {
+		return &S3Error{Status: resp.StatusCode, Code: er.Code, Message: er.Message}
+	}
+	if v == nil {
+		return nil
+	}
+	return errors.Wrap(xml.Unmarshal(data, v), "cannot decode response")
+}
+
+func s3Info(header http.Header, size int64) StorageInfo {
+	modTime, _ := http.ParseTime(header.Get("Last-Modified"))
+	return StorageInfo{
+		Size:    size,
+		ModTime: modTime,
+	}
+}
+
+func (s *S3Storage) Get(name string) (StorageReader, StorageInfo, error) {
+	return s.get(s.key(name))
+}
+
+func (s *S3Storage) get(key string) (StorageReader, StorageInfo, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, StorageInfo{}, err
+	}
+	info := s3Info(resp.Header, resp.ContentLength)
+	return &s3Reader{
+		storage: s,
+		key:     key,
+		etag:    resp.Header.Get("ETag"),
+		size:    info.Size,
+		body:    resp.Body,
+	}, info, nil
+}
+
+func (s *S3Storage) Stat(name string) (StorageInfo, error) {
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil, nil, 0)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	resp.Body.Close()
+	return s3Info(resp.Header, resp.ContentLength), nil
+}
+
+func (s *S3Storage) spool() (*os.File, error) {
+	return ioutil.TempFile(s.SpoolDir, "viadown-spool-")
+}
+
+// RemoveTemporary removes the data spooled by the writers, unless it is kept
+// in the shared temporary directory
+func (s *S3Storage) RemoveTemporary() (count int, size int64, err error) {
+	if s.SpoolDir == "" {
+		return 0, 0, nil
+	}
+	spooled, err := filepath.Glob(filepath.Join(s.SpoolDir, "viadown-spool-*"))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, fpath := range spooled {
+		fi, err := os.Stat(fpath)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if err := os.Remove(fpath); err != nil {
+			log.Errorf("cannot remove spooled data: %v", err)
+			continue
+		}
+		count++
+		size += fi.Size()
+	}
+	return count, size, nil
+}
+
+func (s *S3Storage) Put(name string) (StorageWriter, error) {
+	f, err := s.spool()
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{
+		storage: s,
+		key:     s.key(name),
+		spool:   f,
+	}, nil
+}
+
+// Append obtains the existing data of the object, which is replaced once the
+// writer is closed. The complete parts of the existing data are copied within
+// the object store, rather than uploaded again.
+func (s *S3Storage) Append(name string, offset int64) (StorageWriter, error) {
+	f, err := s.spool()
+	if err != nil {
+		return nil, err
+	}
+	w := &s3Writer{
+		storage: s,
+		key:     s.key(name),
+		spool:   f,
+		keep:    true,
+	}
+	if err := w.fill(offset); err != nil {
+		w.removeSpool()
+		return nil, err
+	}
+	if err := w.copyParts(); err != nil {
+		w.abortUpload()
+		w.removeSpool()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (s *S3Storage) Delete(name string) error {
+	key := s.key(name)
+	// deleting an object that does not exist is not an error in S3
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+	return s.deleteKey(key)
+}
+
+func (s *S3Storage) deleteKey(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Walk lists the objects in the order of their names, the storage has no
+// directories
+func (s *S3Storage) Walk(fn StorageWalkFunc) error {
+	prefix := ""
+	if s.Prefix != "" {
+		prefix = strings.TrimSuffix(s.Prefix, "/") + "/"
+	}
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		var result s3ListBucketResult
+		if err := decodeResponse(resp, &result); err != nil {
+			return errors.Wrap(err, "cannot list objects")
+		}
+		for _, obj := range result.Contents {
+			info := StorageInfo{
+				Size:    obj.Size,
+				ModTime: obj.LastModified,
+			}
+			if err := fn(strings.TrimPrefix(obj.Key, prefix), info); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *S3Storage) putObject(key string, body io.Reader, size int64) error {
+	resp, err := s.do(http.MethodPut, key, nil, nil, body, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) copyObject(from, to string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", awsEscape("/"+s.Bucket+"/"+from, true))
+	resp, err := s.do(http.MethodPut, to, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(decodeResponse(resp, nil), "cannot copy %v to %v", from, to)
+}
+
+// s3Reader reads the data of an object with range requests, the object must
+// not change while it is being read
+type s3Reader struct {
+	storage *S3Storage
+	key     string
+	etag    string
+	size    int64
+	offset  int64
+	// body of the response being read and the offset of its data
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+// get requests the data of the object from first to last byte
+func (r *s3Reader) get(first, last int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%v-%v", first, last))
+	if r.etag != "" {
+		header.Set("If-Match", r.etag)
+	}
+	resp, err := r.storage.do(http.MethodGet, r.key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, errors.Errorf("unexpected response to range request: %v", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body != nil && r.bodyOffset != r.offset {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.body == nil {
+		body, err := r.get(r.offset, r.size-1)
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.bodyOffset = body, r.offset
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	r.bodyOffset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	end := off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+	body, err := r.get(off, end-1)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:end-off])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// s3Writer spools the data to a local file, parts of it are uploaded as soon
+// as there is enough data. The upload is made to the key the writer was
+// obtained for, and the object is copied if committed under another name.
+type s3Writer struct {
+	storage *S3Storage
+	key     string
+	// set for writers obtained with Append, the object is replaced when
+	// the writer is closed
+	keep bool
+	// etag of the existing data of appended object
+	etag   string
+	spool  *os.File
+	size   int64
+	closed bool
+
+	// multipart upload of the data, started once there is enough data
+	uploadKey string
+	uploadID  string
+	parts     []s3Part
+	uploaded  int64
+}
+
+// fill copies up to offset bytes of the existing data of the object to the
+// spool
+func (w *s3Writer) fill(offset int64) error {
+	if offset > 0 {
+		r, _, err := w.storage.get(w.key)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			w.etag = r.(*s3Reader).etag
+			_, err = io.CopyN(w.spool, r, offset)
+			r.Close()
+			if err != nil && err != io.EOF {
+				return err
+			}
+		}
+	}
+	// the data past the existing one reads as zeros, same as files
+	if err := w.spool.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := w.spool.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	w.size = offset
+	return nil
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := w.spool.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if w.size-w.uploaded >= w.storage.partSize() {
+		if err := w.uploadParts(w.key, false); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// startUpload starts the multipart upload to given key, unless it has started
+// already
+func (w *s3Writer) startUpload(key string) error {
+	if w.uploadID != "" {
+		return nil
+	}
+	resp, err := w.storage.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	var result s3InitiateMultipartUploadResult
+	if err := decodeResponse(resp, &result); err != nil {
+		return errors.Wrapf(err, "cannot start upload of %v", key)
+	}
+	w.uploadKey = key
+	w.uploadID = result.UploadID
+	return nil
+}
+
+// copyParts makes the complete parts of the existing data of appended object
+// the first parts of the upload
+func (w *s3Writer) copyParts() error {
+	if w.etag == "" {
+		// there was no data to copy
+		return nil
+	}
+	s := w.storage
+	partSize := s.partSize()
+	for w.size-w.uploaded >= partSize {
+		if err := w.startUpload(w.key); err != nil {
+			return err
+		}
+		number := len(w.parts) + 1
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {w.uploadID},
+		}
+		header := http.Header{}
+		header.Set("X-Amz-Copy-Source", awsEscape("/"+s.Bucket+"/"+w.key, true))
+		header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%v-%v", w.uploaded, w.uploaded+partSize-1))
+		// the object must not have changed since it was read
+		header.Set("X-Amz-Copy-Source-If-Match", w.etag)
+		resp, err := s.do(http.MethodPut, w.uploadKey, query, header, nil, 0)
+		if err != nil {
+			return err
+		}
+		var result s3CopyPartResult
+		if err := decodeResponse(resp, &result); err != nil {
+			return errors.Wrapf(err, "cannot copy part of %v", w.key)
+		}
+		w.parts = append(w.parts, s3Part{PartNumber: number, ETag: result.ETag})
+		w.uploaded += partSize
+	}
+	return nil
+}
+
+// uploadParts uploads the parts of the data that are complete, or all of the
+// remaining data if final is set. The multipart upload to given key is
+// started if needed.
+func (w *s3Writer) uploadParts(key string, final bool) error {
+	s := w.storage
+	partSize := s.partSize()
+	for w.size-w.uploaded >= partSize || final && w.size > w.uploaded {
+		if err := w.startUpload(key); err != nil {
+			return err
+		}
+
+		size := w.size - w.uploaded
+		if size > partSize {
+			size = partSize
+		}
+		number := len(w.parts) + 1
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {w.uploadID},
+		}
+		body := io.NewSectionReader(w.spool, w.uploaded, size)
+		resp, err := s.do(http.MethodPut, w.uploadKey, query, nil, body, size)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		w.parts = append(w.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		w.uploaded += size
+	}
+	return nil
+}
+
+// store uploads the remaining data as an object of given key
+func (w *s3Writer) store(key string) error {
+	s := w.storage
+	if w.uploadID == "" && w.size <= s.partSize() {
+		// small objects are uploaded in a single request
+		return s.putObject(key, io.NewSectionReader(w.spool, 0, w.size), w.size)
+	}
+
+	if err := w.uploadParts(key, true); err != nil {
+		return err
+	}
+	data, err := xml.Marshal(s3CompleteMultipartUpload{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	query := url.Values{"uploadId": {w.uploadID}}
+	resp, err := s.do(http.MethodPost, w.uploadKey, query, nil, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	if err := decodeResponse(resp, nil); err != nil {
+		return errors.Wrapf(err, "cannot complete upload of %v", w.uploadKey)
+	}
+	w.uploadID = ""
+
+	if w.uploadKey != key {
+		if err := s.copyObject(w.uploadKey, key); err != nil {
+			return err
+		}
+		return s.deleteKey(w.uploadKey)
+	}
+	return nil
+}
+
+func (w *s3Writer) abortUpload() {
+	if w.uploadID == "" {
+		return
+	}
+	resp, err := w.storage.do(http.MethodDelete, w.uploadKey, url.Values{"uploadId": {w.uploadID}}, nil, nil, 0)
+	if err != nil {
+		log.Errorf("cannot abort upload of %v: %v", w.uploadKey, err)
+		return
+	}
+	resp.Body.Close()
+	w.uploadID = ""
+}
+
+func (w *s3Writer) removeSpool() {
+	w.spool.Close()
+	if err := os.Remove(w.spool.Name()); err != nil {
+		log.Errorf("cannot remove spooled data %v: %v", w.spool.Name(), err)
+	}
+}
+
+func (w *s3Writer) Open() (StorageReader, error) {
+	return os.Open(w.spool.Name())
+}
+
+// Prepare uploads all of the remaining data, unless the object is small enough
+// to be uploaded in a single request when committed
+func (w *s3Writer) Prepare() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.uploadID == "" && w.size <= w.storage.partSize() {
+		return nil
+	}
+	return w.uploadParts(w.key, true)
+}
+
+func (w *s3Writer) Commit(name string) error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	defer w.removeSpool()
+
+	key := w.storage.key(name)
+	if err := w.store(key); err != nil {
+		w.abortUpload()
+		return err
+	}
+	if w.keep && key != w.key && w.uploadKey != w.key {
+		// the appended object is replaced by the new one, unless it was
+		// the upload that has been moved already
+		if err := w.storage.deleteKey(w.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	defer w.removeSpool()
+
+	w.abortUpload()
+	if w.keep {
+		if err := w.storage.deleteKey(w.key); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if !w.keep {
+		return w.Abort()
+	}
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	defer w.removeSpool()
+
+	if err := w.store(w.key); err != nil {
+		w.abortUpload()
+		return err
+	}
+	return nil
+}
+
+// awsEscape encodes the string as required by AWS signature version 4, all
+// bytes other than the unreserved characters are percent encoded
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsQuery encodes the query sorted by keys and values
+func awsQuery(query url.Values) string {
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 signs the request with AWS signature version 4, all headers of the
+// request are signed along with the host
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		k = strings.ToLower(k)
+		if k == "authorization" {
+			continue
+		}
+		headers[k] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		awsQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey, scope, signedHeaders, signature))
+}
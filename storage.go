@@ -0,0 +1,171 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// StorageInfo describes an object kept in the storage
+type StorageInfo struct {
+	Size    int64
+	ModTime time.Time
+	// IsDir is set for directories, only reported when walking storage
+	// that has them
+	IsDir bool
+	// Links is the number of objects sharing the data, 0 if not known
+	Links int
+}
+
+// StorageReader reads the data of an object
+type StorageReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// StorageWriter writes the data of an object
+type StorageWriter interface {
+	io.Writer
+	// Open returns a reader of the data written so far, the reader remains
+	// valid after the writer is committed
+	Open() (StorageReader, error)
+	// Commit closes the writer and makes the data available as an object
+	// of given name, replacing the existing one
+	Commit(name string) error
+	// Abort closes the writer and discards the data
+	Abort() error
+	// Close closes the writer, the data is kept only if the writer was
+	// obtained with Append
+	Close() error
+}
+
+// StorageWalkFunc is called for each object visited by Storage.Walk, the
+// names use / as a separator. When called for a directory, returning
+// filepath.SkipDir skips its contents.
+type StorageWalkFunc func(name string, info StorageInfo) error
+
+// Storage keeps the objects of the cache. The errors returned for objects
+// that do not exist satisfy os.IsNotExist.
+type Storage interface {
+	// Get opens an object for reading
+	Get(name string) (StorageReader, StorageInfo, error)
+	// Stat returns the information about an object
+	Stat(name string) (StorageInfo, error)
+	// Put returns a writer of a new object, which becomes visible once
+	// committed
+	Put(name string) (StorageWriter, error)
+	// Append returns a writer of an object, which keeps up to offset bytes
+	// of the existing data, the data is kept when the writer is closed and
+	// may become visible as soon as it is written
+	Append(name string, offset int64) (StorageWriter, error)
+	// Delete removes an object
+	Delete(name string) error
+	// Walk visits all the objects in the storage
+	Walk(fn StorageWalkFunc) error
+}
+
+// Linker is implemented by storage in which objects can share their data
+type Linker interface {
+	// Link makes the object named to share the data of the object named
+	// from, replacing the existing one, the modification time of the data
+	// is updated
+	Link(from, to string) error
+}
+
+// TemporaryRemover is implemented by storage that keeps the data of writers in
+// temporary objects, which are left behind if the process is killed before the
+// writers are committed or aborted
+type TemporaryRemover interface {
+	// RemoveTemporary removes all the temporary objects, returns their
+	// number and total size, it must not be called while the storage is
+	// being written
+	RemoveTemporary() (count int, size int64, err error)
+}
+
+// Preparer is implemented by writers that can do the slow part of committing
+// the data, such as syncing or uploading it, before the data is put in place
+type Preparer interface {
+	// Prepare finishes writing the data, after which the writer can only
+	// be committed or aborted
+	Prepare() error
+}
+
+// prepareWriter prepares the writer to be committed, if it is supported
+func prepareWriter(w StorageWriter) error {
+	if p, ok := w.(Preparer); ok {
+		return p.Prepare()
+	}
+	return nil
+}
+
+// cleanName returns the canonical form of an object name
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// readObject returns the data of an object
+func readObject(s Storage, name string) ([]byte, error) {
+	r, _, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// writeObject replaces the data of an object, such that the readers observe
+// either the old or the new contents
+func writeObject(s Storage, name string, data []byte) error {
+	w, err := s.Put(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit(name)
+}
+
+// copyObject copies the data of an object to another one
+func copyObject(s Storage, from, to string) error {
+	r, _, err := s.Get(from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := s.Put(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit(to)
+}
@@ -0,0 +1,177 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, r io.Reader) string {
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func walkNames(t *testing.T, s Storage) []string {
+	var names []string
+	err := s.Walk(func(name string, info StorageInfo) error {
+		if !info.IsDir {
+			names = append(names, name)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	sort.Strings(names)
+	return names
+}
+
+// testStorage checks the behavior common to all implementations of Storage
+func testStorage(t *testing.T, s Storage) {
+	_, _, err := s.Get("foo/bar")
+	assert.True(t, os.IsNotExist(err))
+	_, err = s.Stat("foo/bar")
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, os.IsNotExist(s.Delete("foo/bar")))
+	assert.Empty(t, walkNames(t, s))
+
+	// the data is not visible until committed
+	w, err := s.Put("foo/bar")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = s.Stat("foo/bar")
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, walkNames(t, s))
+
+	// but can be read by following the writer
+	r, err := w.Open()
+	require.NoError(t, err)
+	assert.Equal(t, "hello ", readAll(t, r))
+	_, err = w.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Commit("foo/bar"))
+	assert.Equal(t, "world", readAll(t, r))
+	require.NoError(t, r.Close())
+
+	r, info, err := s.Get("foo/bar")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size)
+	assert.False(t, info.ModTime.IsZero())
+	buf := make([]byte, 5)
+	n, err := r.ReadAt(buf, 6)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "world", string(buf))
+	_, err = r.Seek(-5, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, "world", readAll(t, r))
+	require.NoError(t, r.Close())
+
+	info, err = s.Stat("foo/bar")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size)
+
+	// replacing an object
+	require.NoError(t, writeObject(s, "foo/bar", []byte("hi")))
+	data, err := readObject(s, "foo/bar")
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+
+	// aborted writers leave nothing behind
+	w, err = s.Put("baz")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("baz"))
+	require.NoError(t, err)
+	require.NoError(t, w.Abort())
+	w, err = s.Put("baz")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	_, err = s.Stat("baz")
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, []string{"foo/bar"}, walkNames(t, s))
+
+	// prepared writers are committed or aborted as usual
+	w, err = s.Put("baz")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("baz"))
+	require.NoError(t, err)
+	require.NoError(t, prepareWriter(w))
+	_, err = s.Stat("baz")
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, w.Commit("baz"))
+	data, err = readObject(s, "baz")
+	require.NoError(t, err)
+	assert.Equal(t, "baz", string(data))
+	w, err = s.Put("baz")
+	require.NoError(t, err)
+	require.NoError(t, prepareWriter(w))
+	require.NoError(t, w.Abort())
+	require.NoError(t, s.Delete("baz"))
+	assert.Equal(t, []string{"foo/bar"}, walkNames(t, s))
+
+	// appended data is kept when closed
+	w, err = s.Append("partial", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("12345"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	info, err = s.Stat("partial")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+
+	// the data past the offset is dropped
+	w, err = s.Append("partial", 3)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Commit("done"))
+	data, err = readObject(s, "done")
+	require.NoError(t, err)
+	assert.Equal(t, "123abc", string(data))
+	_, err = s.Stat("partial")
+	assert.True(t, os.IsNotExist(err))
+
+	w, err = s.Append("partial", 0)
+	require.NoError(t, err)
+	require.NoError(t, w.Abort())
+	_, err = s.Stat("partial")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, []string{"done", "foo/bar"}, walkNames(t, s))
+
+	// objects are gone once deleted, but remain available to their
+	// readers
+	r, _, err = s.Get("done")
+	require.NoError(t, err)
+	require.NoError(t, s.Delete("done"))
+	_, err = s.Stat("done")
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "123abc", readAll(t, r))
+	require.NoError(t, r.Close())
+	assert.Equal(t, []string{"foo/bar"}, walkNames(t, s))
+}
@@ -0,0 +1,271 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// UpstreamStats describes the use of connections to upstream
+type UpstreamStats struct {
+	// Requests is the number of requests sent upstream
+	Requests int
+	// ReusedConns is the number of requests sent over a connection that
+	// was kept alive after an earlier request
+	ReusedConns int
+	// Stalled is the number of transfers aborted for exceeding the
+	// transfer limits
+	Stalled int
+}
+
+// UpstreamPool configures the pool of connections to upstream, the zero
+// values are the defaults of http.Transport
+type UpstreamPool struct {
+	// MaxConnsPerHost limits the number of connections to a mirror, 0
+	// means no limit
+	MaxConnsPerHost int
+	// MaxIdleConnsPerHost is the number of idle connections to a mirror
+	// that are kept alive
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is the time after which an idle connection is
+	// closed, 0 means no limit
+	IdleConnTimeout time.Duration
+}
+
+// TransferLimits guard the transfers of data from upstream against mirrors
+// that stop sending data or send it too slowly, the zero values disable them
+type TransferLimits struct {
+	// IdleTimeout is the time after which a transfer that received no data
+	// is aborted
+	IdleTimeout time.Duration
+	// MinThroughput is the rate in bytes per second, averaged over
+	// ThroughputWindow, below which a transfer is aborted
+	MinThroughput    int64
+	ThroughputWindow time.Duration
+}
+
+func (l TransferLimits) checksThroughput() bool {
+	return l.MinThroughput > 0 && l.ThroughputWindow > 0
+}
+
+// idleTimeout returns the time after which a transfer that received no data is
+// aborted, a window with no data at all is always below the minimum throughput
+func (l TransferLimits) idleTimeout() time.Duration {
+	timeout := l.IdleTimeout
+	if l.checksThroughput() && (timeout == 0 || l.ThroughputWindow < timeout) {
+		timeout = l.ThroughputWindow
+	}
+	return timeout
+}
+
+// errTransferStalled indicates that a transfer from upstream exceeded the
+// transfer limits
+type errTransferStalled struct {
+	problem string
+}
+
+func (e *errTransferStalled) Error() string {
+	return fmt.Sprintf("transfer stalled: %v", e.problem)
+}
+
+// retryable returns true if a request that failed with given error can be
+// sent to another mirror. Failures of the request are specific to the mirror,
+// be it unreachable, misconfigured or sending malformed responses, while
+// failures of the download itself, such as when it is aborted, are fatal.
+func retryable(ctx context.Context, err error) bool {
+	var failedErr *errUpstreamFailed
+	return errors.As(err, &failedErr) && ctx.Err() == nil
+}
+
+// isTimeout returns true if the error is caused by a mirror not responding or
+// sending data in time
+func isTimeout(err error) bool {
+	var netErr net.Error
+	var stalledErr *errTransferStalled
+	return (errors.As(err, &netErr) && netErr.Timeout()) ||
+		errors.As(err, &stalledErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// guardedBody enforces the transfer limits while reading the body of an
+// upstream response, the request is canceled once any of them is exceeded
+type guardedBody struct {
+	r       io.Reader
+	limits  TransferLimits
+	cancel  context.CancelFunc
+	timeout time.Duration
+	idle    *time.Timer
+
+	lock    sync.Mutex
+	stalled error
+
+	windowStart time.Time
+	windowSize  int64
+}
+
+func newGuardedBody(r io.Reader, limits TransferLimits, cancel context.CancelFunc) *guardedBody {
+	g := &guardedBody{
+		r:           r,
+		limits:      limits,
+		cancel:      cancel,
+		timeout:     limits.idleTimeout(),
+		windowStart: time.Now(),
+	}
+	if g.timeout > 0 {
+		g.idle = time.AfterFunc(g.timeout, func() {
+			g.stall(fmt.Sprintf("no data received for %v", g.timeout))
+		})
+	}
+	return g
+}
+
+func (g *guardedBody) stall(problem string) error {
+	g.lock.Lock()
+	if g.stalled == nil {
+		g.stalled = &errTransferStalled{problem: problem}
+	}
+	err := g.stalled
+	g.lock.Unlock()
+	g.cancel()
+	return err
+}
+
+func (g *guardedBody) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	if err != nil && err != io.EOF {
+		// the request was likely canceled by the guard
+		g.lock.Lock()
+		if g.stalled != nil {
+			err = g.stalled
+		}
+		g.lock.Unlock()
+		return n, err
+	}
+	if n > 0 && g.idle != nil {
+		g.idle.Reset(g.timeout)
+	}
+	if err == nil && g.limits.checksThroughput() {
+		err = g.checkThroughput(n)
+	}
+	return n, err
+}
+
+// checkThroughput accounts for n bytes received, once the window passes the
+// rate of data in it is checked and a new window starts
+func (g *guardedBody) checkThroughput(n int) error {
+	g.windowSize += int64(n)
+	now := time.Now()
+	elapsed := now.Sub(g.windowStart)
+	if elapsed < g.limits.ThroughputWindow {
+		return nil
+	}
+	rate := g.windowSize * int64(time.Second) / int64(elapsed)
+	if rate < g.limits.MinThroughput {
+		return g.stall(fmt.Sprintf("throughput of %v bytes/s below the minimum of %v bytes/s",
+			rate, g.limits.MinThroughput))
+	}
+	g.windowStart = now
+	g.windowSize = 0
+	return nil
+}
+
+// Stop releases the timer of the guard
+func (g *guardedBody) Stop() {
+	if g.idle != nil {
+		g.idle.Stop()
+	}
+}
+
+// upstream is the client shared by all the requests sent upstream, so that
+// the connections to mirrors are reused
+type upstream struct {
+	once   sync.Once
+	client *http.Client
+
+	stats     UpstreamStats
+	statsLock sync.Mutex
+}
+
+// upstreamClient returns the shared client, which is set up when first used
+func (v *ViaDownloadServer) upstreamClient() *http.Client {
+	v.upstream.once.Do(func() {
+		v.upstream.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{
+					Timeout:   v.ClientTimeout,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				// the dialer is customized, HTTP/2 must be
+				// requested explicitly
+				ForceAttemptHTTP2:     true,
+				TLSHandshakeTimeout:   v.ClientTimeout,
+				ResponseHeaderTimeout: v.ClientTimeout,
+				ExpectContinueTimeout: 1 * time.Second,
+				MaxConnsPerHost:       v.Pool.MaxConnsPerHost,
+				MaxIdleConnsPerHost:   v.Pool.MaxIdleConnsPerHost,
+				IdleConnTimeout:       v.Pool.IdleConnTimeout,
+			},
+		}
+	})
+	return v.upstream.client
+}
+
+// CloseIdleConnections closes the connections to upstream that are not in
+// use
+func (v *ViaDownloadServer) CloseIdleConnections() {
+	v.upstreamClient().CloseIdleConnections()
+}
+
+// traceUpstream returns a context of an upstream request, which records the
+// use of connections
+func (v *ViaDownloadServer) traceUpstream(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			v.upstream.statsLock.Lock()
+			defer v.upstream.statsLock.Unlock()
+			v.upstream.stats.Requests++
+			if info.Reused {
+				v.upstream.stats.ReusedConns++
+			}
+		},
+	})
+}
+
+func (v *ViaDownloadServer) stalled() {
+	v.upstream.statsLock.Lock()
+	defer v.upstream.statsLock.Unlock()
+	v.upstream.stats.Stalled++
+}
+
+// UpstreamStats returns the statistics of connections to upstream
+func (v *ViaDownloadServer) UpstreamStats() UpstreamStats {
+	v.upstream.statsLock.Lock()
+	defer v.upstream.statsLock.Unlock()
+	return v.upstream.stats
+}
@@ -0,0 +1,243 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestViaUpstreamConnReuse(t *testing.T) {
+	remotes := map[string]bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remotes[r.RemoteAddr] = true
+		fmt.Fprintf(w, "data of %v", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+	via := fixture.via
+
+	for _, name := range []string{"/foo", "/bar", "/baz"} {
+		body := assert.HTTPBody(via.ServeHTTP, http.MethodGet, name, nil)
+		assert.Equal(t, "data of "+name, body)
+	}
+	// all the requests went over the same connection
+	assert.Len(t, remotes, 1)
+	assert.Equal(t, UpstreamStats{Requests: 3, ReusedConns: 2}, via.UpstreamStats())
+
+	// the client is shared
+	assert.True(t, via.upstreamClient() == via.upstreamClient())
+	via.CloseIdleConnections()
+	assert.HTTPBody(via.ServeHTTP, http.MethodGet, "/new", nil)
+	assert.Len(t, remotes, 2)
+	assert.Equal(t, UpstreamStats{Requests: 4, ReusedConns: 2}, via.UpstreamStats())
+}
+
+func TestViaUpstreamPool(t *testing.T) {
+	fixture := setupVia(t, nil)
+	defer fixture.Cleanup()
+	via := fixture.via
+
+	via.Pool = UpstreamPool{
+		MaxConnsPerHost:     2,
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     time.Minute,
+	}
+	tr := via.upstreamClient().Transport.(*http.Transport)
+	assert.Equal(t, 2, tr.MaxConnsPerHost)
+	assert.Equal(t, 1, tr.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, tr.IdleConnTimeout)
+	assert.Equal(t, fixture.via.ClientTimeout, tr.ResponseHeaderTimeout)
+}
+
+func TestViaUpstreamHTTP2(t *testing.T) {
+	var protos []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos = append(protos, r.Proto)
+		fmt.Fprintf(w, "data of %v", r.URL.Path)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+	via := fixture.via
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	tr := via.upstreamClient().Transport.(*http.Transport)
+	tr.TLSClientConfig = &tls.Config{RootCAs: roots}
+
+	for _, name := range []string{"/foo", "/bar"} {
+		body := assert.HTTPBody(via.ServeHTTP, http.MethodGet, name, nil)
+		assert.Equal(t, "data of "+name, body)
+	}
+	require.Len(t, protos, 2)
+	assert.Equal(t, []string{"HTTP/2.0", "HTTP/2.0"}, protos)
+	assert.Equal(t, UpstreamStats{Requests: 2, ReusedConns: 1}, via.UpstreamStats())
+}
+
+func TestViaUpstreamStalled(t *testing.T) {
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	content := "hello world"
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(content[:6]))
+		w.(http.Flusher).Flush()
+		// no more data until the client gives up
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+	var ranges []string
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "foo", modTime, strings.NewReader(content))
+	}))
+	defer good.Close()
+
+	fixture := setupVia(t, []string{stalled.URL, good.URL})
+	defer fixture.Cleanup()
+	via := fixture.via
+	via.Limits = TransferLimits{IdleTimeout: 100 * time.Millisecond}
+
+	// the download is completed from the next mirror
+	body := assert.HTTPBody(via.ServeHTTP, http.MethodGet, "/foo", nil)
+	assert.Equal(t, content, body)
+	assert.Equal(t, []string{"bytes=6-"}, ranges)
+	assert.Equal(t, 1, via.UpstreamStats().Stalled)
+
+	in, _, err := fixture.cache.Get("foo")
+	require.NoError(t, err)
+	defer in.Close()
+	data, _ := ioutil.ReadAll(in)
+	assert.Equal(t, []byte(content), data)
+}
+
+// slowReader returns a byte of data at a time, after a delay
+type slowReader struct {
+	data  string
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestGuardedBodyThroughput(t *testing.T) {
+	limits := TransferLimits{
+		MinThroughput:    1000,
+		ThroughputWindow: 50 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	body := newGuardedBody(&slowReader{data: strings.Repeat("x", 100), delay: 10 * time.Millisecond}, limits, cancel)
+	defer body.Stop()
+	data, err := ioutil.ReadAll(body)
+	var stalledErr *errTransferStalled
+	require.True(t, errors.As(err, &stalledErr), "unexpected error %v", err)
+	assert.Contains(t, err.Error(), "below the minimum of 1000 bytes/s")
+	assert.True(t, len(data) < 100)
+	// the request is canceled
+	assert.Error(t, ctx.Err())
+
+	// fast enough
+	ctx, cancel = context.WithCancel(context.Background())
+	body = newGuardedBody(&slowReader{data: strings.Repeat("x", 10)}, limits, cancel)
+	defer body.Stop()
+	data, err = ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Len(t, data, 10)
+	assert.NoError(t, ctx.Err())
+}
+
+func TestTransferLimitsIdleTimeout(t *testing.T) {
+	assert.Equal(t, time.Duration(0), TransferLimits{}.idleTimeout())
+	assert.Equal(t, time.Minute, TransferLimits{IdleTimeout: time.Minute}.idleTimeout())
+	// a window without any data is below the minimum throughput
+	assert.Equal(t, 30*time.Second, TransferLimits{
+		IdleTimeout:      time.Minute,
+		MinThroughput:    1,
+		ThroughputWindow: 30 * time.Second,
+	}.idleTimeout())
+	assert.Equal(t, 30*time.Second, TransferLimits{
+		MinThroughput:    1,
+		ThroughputWindow: 30 * time.Second,
+	}.idleTimeout())
+}
+
+func TestRetryable(t *testing.T) {
+	failed := func(err error) error {
+		return &errUpstreamFailed{err: &url.Error{Op: "Get", URL: "http://mirror/foo", Err: err}}
+	}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{failed(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), true},
+		{failed(&net.DNSError{Err: "no such host", Name: "mirror"}), true},
+		{failed(io.EOF), true},
+		{failed(context.DeadlineExceeded), true},
+		{failed(x509.UnknownAuthorityError{}), true},
+		{failed(x509.HostnameError{Host: "mirror"}), true},
+		// specific to the mirror
+		{failed(errors.New("stopped after 10 redirects")), true},
+		{failed(errors.New("unsupported protocol scheme")), true},
+		{failed(errors.New("malformed HTTP response")), true},
+		// not a failure of the request
+		{errors.New("cannot write to cache"), false},
+		{&errUpstreamInterrupted{err: io.ErrUnexpectedEOF}, false},
+	} {
+		assert.Equal(t, tc.retryable, retryable(ctx, tc.err), "error %v", tc.err)
+	}
+
+	// the download was aborted
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, retryable(ctx, failed(&net.OpError{Op: "read", Net: "tcp", Err: errors.New("reset")})))
+}
@@ -0,0 +1,195 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// reserve makes room for an entry of given size that is about to be written
+func (c *Cache) reserve(size int64) {
+	if c.MaxSize == 0 || size <= 0 {
+		return
+	}
+
+	c.indexLock.Lock()
+	if err := c.loadIndexLocked(); err != nil {
+		c.indexLock.Unlock()
+		log.Errorf("cannot load cache index: %v", err)
+		return
+	}
+	victims := c.selectVictimsLocked(size, "")
+	c.indexLock.Unlock()
+
+	c.evict(victims)
+}
+
+// selectVictimsLocked drops the least recently used entries, which are not in
+// use, from the index until there is enough room for extra bytes of data and
+// returns them, the entry named keep is never selected
+func (c *Cache) selectVictimsLocked(extra int64, keep string) []*indexEntry {
+	var victims []*indexEntry
+	for el := c.index.lru.Back(); el != nil && c.index.total+extra > c.MaxSize; {
+		prev := el.Prev()
+		ie := el.Value.(*indexEntry)
+		if c.index.inUse[ie.name] == 0 && ie.name != keep {
+			log.Infof("evicting %v, last used at %v", ie.name, ie.lastUsed)
+			victims = append(victims, ie)
+			c.dropLocked(el)
+		}
+		el = prev
+	}
+	if c.index.total+extra > c.MaxSize {
+		log.Infof("cache size %v over the limit of %v, remaining entries are in use",
+			c.index.total+extra, c.MaxSize)
+	}
+	return victims
+}
+
+// evict removes the entries selected for eviction
+func (c *Cache) evict(victims []*indexEntry) {
+	for _, ie := range victims {
+		unlock := c.lockEntry(ie.name)
+		// readers have the entry locked while marking it as being in
+		// use, check again now that it cannot be opened and keep
+		// tracking the entry if it is not evicted after all
+		c.indexLock.Lock()
+		inUse := c.index.inUse[ie.name] > 0
+		if inUse {
+			c.restoreLocked(ie)
+		}
+		c.indexLock.Unlock()
+
+		if inUse {
+			log.Debugf("entry %v is in use, not evicting", ie.name)
+		} else if err := c.removeEntryLocked(ie.name); err != nil && !os.IsNotExist(err) {
+			log.Errorf("cannot evict %v: %v", ie.name, err)
+		}
+		unlock()
+	}
+}
+
+// restoreLocked puts back an entry dropped from the index, unless the entry
+// has been tracked again in the meantime
+func (c *Cache) restoreLocked(ie *indexEntry) {
+	if _, ok := c.index.entries[ie.name]; ok || !c.index.loaded {
+		return
+	}
+	c.index.entries[ie.name] = c.index.lru.PushBack(ie)
+	c.chargeLocked(ie, 1)
+	c.indexChangedLocked()
+}
+
+// removeEntryLocked removes the entry, which must be locked by the caller,
+// returns an error that satisfies os.IsNotExist if the entry is not there
+func (c *Cache) removeEntryLocked(name string) error {
+	// the digest identifies the blob the data may be shared with
+	meta, merr := readMeta(c.storage(), c.getMetaName(name))
+	err := c.storage().Delete(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	c.removed(name)
+	if err := c.removeMeta(name); err != nil {
+		log.Errorf("cannot remove metadata of %v: %v", name, err)
+	}
+	if merr == nil {
+		c.releaseBlob(meta.Digest)
+	}
+	return err
+}
+
+// acquire marks the entry as being in use, so that it is not evicted
+func (c *Cache) acquire(name string) {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if c.index.inUse == nil {
+		c.index.inUse = make(map[string]int)
+	}
+	c.index.inUse[indexKey(name)]++
+}
+
+func (c *Cache) release(name string) {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	name = indexKey(name)
+	c.index.inUse[name]--
+	if c.index.inUse[name] <= 0 {
+		delete(c.index.inUse, name)
+	}
+}
+
+// cacheReader is an entry being read, which is released when closed
+type cacheReader struct {
+	StorageReader
+	release func()
+}
+
+func (r *cacheReader) Close() error {
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
+	return r.StorageReader.Close()
+}
+
+// ByteSize is a size in bytes, which can be set from a string with an optional
+// K, M, G or T suffix of binary multiples
+type ByteSize int64
+
+var byteSizeSuffixes = []string{"K", "M", "G", "T"}
+
+func (b *ByteSize) Set(s string) error {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	for i, suffix := range byteSizeSuffixes {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSuffix(s, suffix)
+			mult = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+	val, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || val < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = ByteSize(val * mult)
+	return nil
+}
+
+func (b ByteSize) String() string {
+	val := int64(b)
+	suffix := ""
+	for _, s := range byteSizeSuffixes {
+		if val == 0 || val%1024 != 0 {
+			break
+		}
+		val /= 1024
+		suffix = s
+	}
+	return strconv.FormatInt(val, 10) + suffix
+}
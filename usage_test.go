@@ -0,0 +1,231 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2026 Maciek Borzecki <maciek.borzecki@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func putEntry(t *testing.T, c *Cache, name, data string) {
+	ct, err := c.Put(name)
+	require.NoError(t, err)
+	_, err = ct.WriteString(data)
+	require.NoError(t, err)
+	require.NoError(t, ct.Commit())
+}
+
+func assertEntries(t *testing.T, c *Cache, exist []string, gone []string) {
+	for _, name := range exist {
+		_, err := os.Stat(filepath.Join(c.Dir, name))
+		assert.NoError(t, err, "entry %v should exist", name)
+	}
+	for _, name := range gone {
+		_, err := os.Stat(filepath.Join(c.Dir, name))
+		assert.True(t, os.IsNotExist(err), "entry %v should be gone", name)
+		_, err = c.GetMeta(name)
+		assert.True(t, os.IsNotExist(err), "metadata of %v should be gone", name)
+	}
+}
+
+func TestCacheEvictLRU(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-usage-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td, MaxSize: 10}
+
+	putEntry(t, &c, "foo", "1234")
+	putEntry(t, &c, "bar/baz", "5678")
+	assert.Equal(t, int64(8), c.index.total)
+
+	// foo becomes the most recently used entry
+	r, _, err := c.Get("foo")
+	require.NoError(t, err)
+	r.Close()
+
+	putEntry(t, &c, "new", "abcd")
+	assertEntries(t, &c, []string{"foo", "new"}, []string{"bar/baz"})
+	assert.Equal(t, int64(8), c.index.total)
+
+	// replacing an entry accounts for the new size
+	putEntry(t, &c, "foo", "12")
+	assert.Equal(t, int64(6), c.index.total)
+
+	// purged entries are no longer tracked
+	_, err = c.Purge(PurgeSelector{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), c.index.total)
+	assert.Equal(t, 0, c.index.lru.Len())
+}
+
+func TestCacheEvictSkipsInUse(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-usage-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td, MaxSize: 10}
+
+	putEntry(t, &c, "foo", "efgh")
+	putEntry(t, &c, "bar", "ijkl")
+
+	// foo is being read
+	r, _, err := c.Get("foo")
+	require.NoError(t, err)
+	// bar is being replaced
+	d, _ := c.StartDownload("/bar")
+
+	putEntry(t, &c, "baz", "mnop")
+	// nothing could be evicted
+	assertEntries(t, &c, []string{"foo", "bar", "baz"}, nil)
+
+	r.Close()
+	err = d.Finish(nil)
+	require.NoError(t, err)
+
+	putEntry(t, &c, "new", "qrst")
+	assertEntries(t, &c, []string{"baz", "new"}, []string{"foo", "bar"})
+}
+
+func TestCacheEvictInUseKeepsTracking(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-usage-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td, MaxSize: 10}
+
+	putEntry(t, &c, "foo", "1234")
+	putEntry(t, &c, "bar", "5678")
+
+	c.indexLock.Lock()
+	victims := c.selectVictimsLocked(4, "")
+	c.indexLock.Unlock()
+	require.Len(t, victims, 1)
+	assert.Equal(t, "foo", victims[0].name)
+	assert.Equal(t, int64(4), c.index.total)
+
+	// a reader marks foo as being in use before it is evicted
+	c.acquire("foo")
+	defer c.release("foo")
+
+	c.evict(victims)
+	assertEntries(t, &c, []string{"foo", "bar"}, nil)
+	assert.Equal(t, int64(8), c.index.total)
+	assert.Equal(t, 2, c.index.lru.Len())
+}
+
+func TestCacheEvictLoadsExisting(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-usage-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	now := time.Now()
+	for i, name := range []string{"old", "older", "oldest"} {
+		fpath := filepath.Join(td, name)
+		makeFile(t, fpath, []byte("1234"))
+		mtime := now.Add(-time.Duration(i+1) * time.Hour)
+		require.NoError(t, os.Chtimes(fpath, mtime, mtime))
+	}
+	// temporary objects are not entries
+	makeFile(t, filepath.Join(td, "foo.part.1234"), []byte("1234"))
+
+	c := Cache{Dir: td, MaxSize: 10}
+
+	putEntry(t, &c, "new", "uvwx")
+	assertEntries(t, &c, []string{"new", "old", "foo.part.1234"}, []string{"older", "oldest"})
+	assert.Equal(t, int64(8), c.index.total)
+}
+
+func TestCacheEvictReserve(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-usage-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td, MaxSize: 10}
+
+	putEntry(t, &c, "foo", "wxyz")
+	putEntry(t, &c, "bar", "4321")
+
+	// room is made as soon as the size of the data is known
+	d, _ := c.StartDownload("/baz")
+	err = d.Begin("", http.Header{"Content-Length": []string{"4"}}, 0)
+	require.NoError(t, err)
+	assertEntries(t, &c, []string{"bar"}, []string{"foo"})
+
+	_, rd, err := d.Follow(context.Background())
+	require.NoError(t, err)
+	defer rd.Close()
+	_, err = d.Write([]byte("1234"))
+	require.NoError(t, err)
+	require.NoError(t, d.Finish(nil))
+	assertEntries(t, &c, []string{"bar", "baz"}, nil)
+}
+
+func TestCacheNoLimit(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-usage-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	putEntry(t, &c, "foo", "8765")
+	putEntry(t, &c, "bar", "dcba")
+	assertEntries(t, &c, []string{"foo", "bar"}, nil)
+	assert.Equal(t, int64(8), c.index.total)
+}
+
+func TestByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		val ByteSize
+		out string
+	}{
+		{"0", 0, "0"},
+		{"1000", 1000, "1000"},
+		{"2048", 2048, "2K"},
+		{"2K", 2048, "2K"},
+		{"10m", 10 << 20, "10M"},
+		{"10MB", 10 << 20, "10M"},
+		{"3G", 3 << 30, "3G"},
+		{"1T", 1 << 40, "1T"},
+		{"2048T", 2048 << 40, "2048T"},
+	} {
+		var b ByteSize
+		err := b.Set(tc.in)
+		assert.NoError(t, err, tc.in)
+		assert.Equal(t, tc.val, b, tc.in)
+		assert.Equal(t, tc.out, b.String(), tc.in)
+	}
+
+	for _, in := range []string{"", "foo", "1P", "-1", "1.5G"} {
+		var b ByteSize
+		assert.Error(t, b.Set(in), in)
+	}
+}
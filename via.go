@@ -23,15 +23,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -59,13 +60,139 @@ func (e *errUpstreamBadStatus) Error() string {
 		e.Upstream, e.Rsp.StatusCode, e.Body.Len(), e.Body.String())
 }
 
+// errUpstreamInterrupted indicates that transfer of data from upstream broke
+// before all of it was received
+type errUpstreamInterrupted struct {
+	err error
+}
+
+func (e *errUpstreamInterrupted) Error() string {
+	return fmt.Sprintf("upstream transfer interrupted: %v", e.err)
+}
+
+func (e *errUpstreamInterrupted) Unwrap() error { return e.err }
+
+// errLengthMismatch indicates that the size of the data received from
+// upstream differs from the announced one
+type errLengthMismatch struct {
+	Upstream string
+	Expected int64
+	Got      int64
+}
+
+func (e *errLengthMismatch) Error() string {
+	return fmt.Sprintf("data from upstream %q is %v bytes, expected %v", e.Upstream, e.Got, e.Expected)
+}
+
+// errResumeMismatch indicates that the download cannot be continued with the
+// data from given upstream
+type errResumeMismatch struct {
+	Upstream string
+	err      error
+}
+
+func (e *errResumeMismatch) Error() string {
+	return fmt.Sprintf("cannot continue download from upstream %q: %v", e.Upstream, e.err)
+}
+
+// errMirrorsExhausted indicates that none of the mirrors provided the data,
+// the error of every mirror that was tried is kept
+type errMirrorsExhausted struct {
+	errs []mirrorError
+}
+
+type mirrorError struct {
+	Mirror string
+	err    error
+}
+
+func (e *errMirrorsExhausted) Error() string {
+	if len(e.errs) == 0 {
+		return "mirrors exhausted"
+	}
+	last := e.errs[len(e.errs)-1]
+	return fmt.Sprintf("mirrors exhausted, last error: %v", last.err)
+}
+
+// unreachable returns true if none of the mirrors could be reached, that is
+// every mirror failed to connect, timed out, stalled or responded with a
+// server error
+func (e *errMirrorsExhausted) unreachable() bool {
+	for _, me := range e.errs {
+		var failedErr *errUpstreamFailed
+		var badStatusErr *errUpstreamBadStatus
+		switch {
+		case errors.As(me.err, &failedErr), isTimeout(me.err):
+		case errors.As(me.err, &badStatusErr) && badStatusErr.Rsp.StatusCode >= http.StatusInternalServerError:
+		default:
+			return false
+		}
+	}
+	return len(e.errs) > 0
+}
+
+// status returns the status of the response, 404 if every mirror responded
+// that it does not have the data, 504 if the remaining ones timed out, 502
+// otherwise
+func (e *errMirrorsExhausted) status() int {
+	notFound, timeout := true, true
+	for _, me := range e.errs {
+		var badStatusErr *errUpstreamBadStatus
+		if errors.As(me.err, &badStatusErr) && badStatusErr.Rsp.StatusCode < http.StatusInternalServerError {
+			continue
+		}
+		notFound = false
+		if !isTimeout(me.err) {
+			timeout = false
+		}
+	}
+	switch {
+	case notFound:
+		return http.StatusNotFound
+	case timeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// errEntryNotModified indicates that upstream confirmed the cache entry to be
+// up to date
+var errEntryNotModified = errors.New("cache entry not modified upstream")
+
+// warnings sent along with stale cache entries
+const (
+	warnRevalidationFailed = `111 - "Revalidation Failed"`
+	warnDisconnected       = `112 - "Disconnected Operation"`
+)
+
+// headers of the upstream response that are passed to the client
+var forwardedHeaders = []string{
+	"Content-Type", "Content-Length",
+	"ETag", "Last-Modified",
+	"Date",
+}
+
 type ViaDownloadServer struct {
 	Mirrors       Mirrors
 	Cache         *Cache
 	ClientTimeout time.Duration
-	Router        *mux.Router
-	vfs           http.FileSystem
-	httpFs        http.Handler
+	// Pool configures the connections to upstream, it must be set before
+	// the first request is served
+	Pool UpstreamPool
+	// Limits guard the transfers of data from upstream
+	Limits TransferLimits
+	// Breaker configures skipping of mirrors that keep failing
+	Breaker   MirrorBreaker
+	Freshness FreshnessPolicy
+	Router    *mux.Router
+	vfs       http.FileSystem
+	httpFs    http.Handler
+	// non 0 when upstream must not be contacted
+	offline  int32
+	upstream upstream
+	health   mirrorHealth
+	fsck     fsckRunner
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
@@ -90,6 +217,11 @@ func NewViaDownloadServer(mirrors Mirrors, cache *Cache, clientTimeout time.Dura
 	r.HandleFunc("/_viadown/count", vs.countHandler).Methods(http.MethodGet)
 	r.HandleFunc("/_viadown/stats", vs.statsHandler).Methods(http.MethodGet)
 	r.HandleFunc("/_viadown/data", vs.dataDeleteHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/_viadown/fsck", vs.fsckGetHandler).Methods(http.MethodGet)
+	r.HandleFunc("/_viadown/fsck", vs.fsckHandler).Methods(http.MethodPost)
+	r.HandleFunc("/_viadown/mirrors", vs.mirrorsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/_viadown/offline", vs.offlineGetHandler).Methods(http.MethodGet)
+	r.HandleFunc("/_viadown/offline", vs.offlinePutHandler).Methods(http.MethodPut)
 	r.PathPrefix("/_viadown/static").Handler(http.StripPrefix("/_viadown/static", vs.httpFs))
 	r.PathPrefix("/_viadown/").Handler(http.StripPrefix("/_viadown/", vs.httpFs))
 	r.Handle("/_viadown", http.RedirectHandler("/_viadown/", http.StatusMovedPermanently))
@@ -116,15 +248,33 @@ func (v *ViaDownloadServer) returnError(w http.ResponseWriter, status int, err e
 }
 
 func (v *ViaDownloadServer) returnOk(w http.ResponseWriter, what interface{}) {
+	v.returnStatus(w, http.StatusOK, what)
+}
+
+func (v *ViaDownloadServer) returnStatus(w http.ResponseWriter, status int, what interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	enc := json.NewEncoder(w)
 	enc.Encode(what)
 }
 
+// viaStats are the statistics of the cache and of the connections to upstream
+type viaStats struct {
+	CacheStats
+	Upstream UpstreamStats
+}
+
 func (v *ViaDownloadServer) statsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Infof("stats handler")
-	v.returnOk(w, v.Cache.Stats())
+	v.returnOk(w, viaStats{
+		CacheStats: v.Cache.Stats(),
+		Upstream:   v.UpstreamStats(),
+	})
+}
+
+func (v *ViaDownloadServer) mirrorsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Infof("mirrors handler")
+	v.returnOk(w, v.MirrorStatus())
 }
 
 func (v *ViaDownloadServer) countHandler(w http.ResponseWriter, r *http.Request) {
@@ -153,9 +303,26 @@ func (v *ViaDownloadServer) dataDeleteHandler(w http.ResponseWriter, r *http.Req
 		v.returnError(w, http.StatusBadRequest, errors.New("older-than-days is not an integer"))
 		return
 	}
-	removed, err := v.Cache.Purge(PurgeSelector{
+	what := PurgeSelector{
 		OlderThan: time.Duration(olderThanDays) * 24 * time.Hour,
-	})
+	}
+	if s := r.FormValue("not-accessed-for-days"); s != "" {
+		notAccessedForDays, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			v.returnError(w, http.StatusBadRequest, errors.New("not-accessed-for-days is not an integer"))
+			return
+		}
+		what.NotAccessedFor = time.Duration(notAccessedForDays) * 24 * time.Hour
+	}
+	if s := r.FormValue("min-hits"); s != "" {
+		minHits, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			v.returnError(w, http.StatusBadRequest, errors.New("min-hits is not an integer"))
+			return
+		}
+		what.MinHits = int(minHits)
+	}
+	removed, err := v.Cache.Purge(what)
 	if err != nil {
 		v.returnError(w, http.StatusInternalServerError, err)
 		return
@@ -166,96 +333,287 @@ func (v *ViaDownloadServer) dataDeleteHandler(w http.ResponseWriter, r *http.Req
 	v.returnOk(w, removedInfo{Removed: removed})
 }
 
+// fsckHandler starts a check of the cache in the background, only one check
+// runs at a time
+func (v *ViaDownloadServer) fsckHandler(w http.ResponseWriter, r *http.Request) {
+	log.Infof("cache check handler")
+	status := http.StatusAccepted
+	if !v.fsck.start(v.Cache) {
+		status = http.StatusConflict
+	}
+	v.returnStatus(w, status, v.fsck.status())
+}
+
+// StopFsck interrupts the check of the cache running in the background and
+// waits for it to finish until ctx is done
+func (v *ViaDownloadServer) StopFsck(ctx context.Context) error {
+	return v.fsck.stop(ctx)
+}
+
+func (v *ViaDownloadServer) fsckGetHandler(w http.ResponseWriter, r *http.Request) {
+	log.Infof("cache check status handler")
+	v.returnOk(w, v.fsck.status())
+}
+
+type offlineInfo struct {
+	Offline bool
+}
+
+func (v *ViaDownloadServer) offlineGetHandler(w http.ResponseWriter, r *http.Request) {
+	log.Infof("offline get handler")
+	v.returnOk(w, offlineInfo{Offline: v.IsOffline()})
+}
+
+func (v *ViaDownloadServer) offlinePutHandler(w http.ResponseWriter, r *http.Request) {
+	log.Infof("offline put handler")
+	if err := r.ParseForm(); err != nil {
+		v.returnError(w, http.StatusBadRequest, errors.New("malformed request"))
+		return
+	}
+	s := r.FormValue("enabled")
+	if s == "" {
+		v.returnError(w, http.StatusBadRequest, errors.New("enabled not provided"))
+		return
+	}
+	enabled, err := strconv.ParseBool(s)
+	if err != nil {
+		v.returnError(w, http.StatusBadRequest, errors.New("enabled is not a boolean"))
+		return
+	}
+	v.SetOffline(enabled)
+	v.returnOk(w, offlineInfo{Offline: v.IsOffline()})
+}
+
+// SetOffline enables or disables the offline mode, in which the requests are
+// served from cache only and upstream is never contacted
+func (v *ViaDownloadServer) SetOffline(offline bool) {
+	var val int32
+	if offline {
+		val = 1
+	}
+	if atomic.SwapInt32(&v.offline, val) != val {
+		log.Infof("offline mode: %v", offline)
+	}
+}
+
+func (v *ViaDownloadServer) IsOffline() bool {
+	return atomic.LoadInt32(&v.offline) != 0
+}
+
 func (v *ViaDownloadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	v.Router.ServeHTTP(w, r)
 }
 
 func (v *ViaDownloadServer) maybeCachedHandler(w http.ResponseWriter, r *http.Request) {
-	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
-		log.Debugf("has modified since: %v, poke upstream first", since)
+	meta, fresh := v.checkFreshness(r.URL.Path, r)
+	if v.IsOffline() {
+		v.offlineHandler(w, r, meta, fresh)
+		return
+	}
+	if !fresh {
+		v.fromUpstreamHandler(w, r, meta)
+		return
+	}
+
+	found, err := doFromCache(r.URL.Path, w, r, v.Cache, meta)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if found {
+		return
+	}
+
+	v.fromUpstreamHandler(w, r, nil)
+}
+
+// offlineHandler serves the data from cache only, entries that would otherwise
+// be checked with upstream are served as stale
+func (v *ViaDownloadServer) offlineHandler(w http.ResponseWriter, r *http.Request, meta *EntryMeta, fresh bool) {
+	var found bool
+	var err error
+	if fresh {
+		found, err = doFromCache(r.URL.Path, w, r, v.Cache, meta)
 	} else {
-		// no modified since header, try to get from cache
-		found, err := doFromCache(r.URL.Path, w, r, v.Cache)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		found, err = doStaleFromCache(r.URL.Path, w, r, v.Cache, meta, warnDisconnected)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		fmt.Fprintf(w, "error: offline mode, %v not in cache\n", r.URL.Path)
+	}
+}
+
+// checkFreshness returns true if the cache entry can be served without
+// consulting upstream. The metadata of the entry is returned, if it had to be
+// obtained and there is any, so that the entry can be revalidated or served
+// without obtaining the metadata again.
+func (v *ViaDownloadServer) checkFreshness(name string, r *http.Request) (meta *EntryMeta, fresh bool) {
+	rule := v.Freshness.Rule(name)
+	if rule == nil {
+		// no rule for the entry, check with upstream only when the
+		// client asks for it
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+			log.Debugf("has modified since: %v, poke upstream first", since)
+			return getMeta(v.Cache, name), false
 		}
-		if found {
-			return
+		return nil, true
+	}
+	meta = getMeta(v.Cache, name)
+	if rule.IsFresh(meta, time.Now()) {
+		return meta, true
+	}
+	log.Debugf("entry %v is stale according to rule %v", name, rule)
+	return meta, false
+}
+
+// getMeta returns the metadata of the cache entry, or nil if there is none
+func getMeta(cache *Cache, name string) *EntryMeta {
+	meta, err := cache.GetMeta(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("cannot obtain metadata of %v: %v", name, err)
 		}
+		return nil
 	}
+	return meta
+}
 
-	v.fromUpstreamHandler(w, r)
+// fromUpstreamHandler serves the data from upstream. When the metadata of a
+// stale cache entry is provided, the entry is revalidated, and is downloaded
+// again only if it has changed.
+func (v *ViaDownloadServer) fromUpstreamHandler(w http.ResponseWriter, r *http.Request, stale *EntryMeta) {
+	d, isNew := v.Cache.StartDownload(r.URL.Path)
+	if isNew {
+		// the download is owned by the cache and continues in the
+		// background even if the client goes away
+		go v.download(d, stale)
+	} else {
+		log.Debugf("download of %v already in progress", r.URL.Path)
+	}
+	followDownload(w, r, d)
 }
 
-func (v *ViaDownloadServer) newClient() *http.Client {
-	return &http.Client{
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout: v.ClientTimeout,
-			}).Dial,
-			TLSHandshakeTimeout:   v.ClientTimeout,
-			ResponseHeaderTimeout: v.ClientTimeout,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
+func (v *ViaDownloadServer) download(d *Download, stale *EntryMeta) {
+	err := v.tryMirrors(d, stale)
+	if err := d.Finish(err); err != nil {
+		log.Errorf("failed to finish cache entry: %v", err)
 	}
 }
 
-func (v *ViaDownloadServer) fromUpstreamHandler(w http.ResponseWriter, r *http.Request) {
-	var lastErr error
+func (v *ViaDownloadServer) tryMirrors(d *Download, stale *EntryMeta) error {
+	var errs []mirrorError
 
-	for idx, mirror := range v.Mirrors {
-		err := v.tryMirror(mirror, w, r)
+	for _, mirror := range v.orderedMirrors() {
+		err := v.tryMirror(mirror, d, stale)
 		var badStatusErr *errUpstreamBadStatus
+		var interruptedErr *errUpstreamInterrupted
+		var mismatchErr *errResumeMismatch
 		switch {
-		case err == nil:
-			return
+		case err == nil, err == errEntryNotModified:
+			return err
 		case errors.As(err, &badStatusErr):
-			passthrough := badStatusErr.Rsp.StatusCode == http.StatusNotModified
-			if passthrough {
-				rsp := badStatusErr.Rsp
-				copyHeaders(w.Header(), rsp.Header,
-					[]string{"Content-Type", "Content-Length",
-						"ETag", "Last-Modified",
-						"Date"})
-				w.WriteHeader(rsp.StatusCode)
-				// original response body was consumed, use the copy
-				io.Copy(w, &badStatusErr.Body)
-				return
-			}
-			if !HasMoreMirrors(idx, v.Mirrors) {
-				lastErr = err
+			if badStatusErr.Rsp.StatusCode == http.StatusNotModified {
+				return err
 			}
+		case errors.As(err, &interruptedErr), errors.As(err, &mismatchErr),
+			retryable(d.Context(), err):
+			// the download will continue with the next mirror
+			log.Errorf("mirror %v failed: %v", mirror, err)
 		default:
 			log.Errorf("mirror failed: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Header().Add("Content-Type", "text/plain")
-			fmt.Fprintf(w, "error processing request: %v\n", err)
-			return
+			return err
 		}
+		errs = append(errs, mirrorError{Mirror: mirror, err: err})
 	}
+	return &errMirrorsExhausted{errs: errs}
+}
 
-	// not found
-	w.WriteHeader(http.StatusNotFound)
-	w.Header().Add("Content-Type", "text/plain")
-	fmt.Fprintf(w, "error: mirrors exhausted\n")
-	if lastErr != nil {
-		fmt.Fprintf(w, "error from last mirror:\n - %v\n", lastErr)
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	var badStatusErr *errUpstreamBadStatus
+	var exhaustedErr *errMirrorsExhausted
+	var failedErr *errUpstreamFailed
+	switch {
+	case errors.As(err, &exhaustedErr):
+		w.Header().Add("Content-Type", "text/plain")
+		w.WriteHeader(exhaustedErr.status())
+		fmt.Fprintf(w, "error: mirrors exhausted\n")
+		if len(exhaustedErr.errs) > 0 {
+			fmt.Fprintf(w, "errors from mirrors:\n")
+		}
+		for _, me := range exhaustedErr.errs {
+			fmt.Fprintf(w, " - %v: %v\n", me.Mirror, me.err)
+		}
+	case errors.As(err, &badStatusErr) && badStatusErr.Rsp.StatusCode == http.StatusNotModified:
+		rsp := badStatusErr.Rsp
+		copyHeaders(w.Header(), rsp.Header, forwardedHeaders)
+		w.WriteHeader(rsp.StatusCode)
+		// original response body was consumed, use the copy, the
+		// error may be shared by many requesters
+		w.Write(badStatusErr.Body.Bytes())
+	case errors.As(err, &failedErr):
+		w.Header().Add("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "error: %v\n", err)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Header().Add("Content-Type", "text/plain")
+		fmt.Fprintf(w, "error processing request: %v\n", err)
 	}
 }
 
-func (v *ViaDownloadServer) tryMirror(mirror string, w http.ResponseWriter, r *http.Request) error {
+func (v *ViaDownloadServer) tryMirror(mirror string, d *Download, stale *EntryMeta) error {
 	log.Debugf("trying mirror %v", mirror)
-	url := buildURL(mirror, r.URL.Path)
+	url := buildURL(mirror, d.Name)
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
+		// the address of the mirror is malformed
 		log.Errorf("failed to prepare request: %v", err)
-		w.WriteHeader(http.StatusBadGateway)
-		return fmt.Errorf("cannot prepare request: %w", err)
+		return &errUpstreamFailed{err: fmt.Errorf("cannot prepare request: %w", err)}
 	}
-	return doFromUpstream(r.URL.Path, v.newClient(), req, w, v.Cache)
+	conditional := stale != nil && setConditionalHeaders(req, stale)
+
+	ctx, sample := sampleMirror(v.traceUpstream(d.Context()), d)
+	err = doFromUpstream(d, v.upstreamClient(), req.WithContext(ctx), v.Limits)
+	v.recordMirror(mirror, sample, d, err)
+	var stalledErr *errTransferStalled
+	if errors.As(err, &stalledErr) {
+		v.stalled()
+	}
+	var badStatusErr *errUpstreamBadStatus
+	if conditional && errors.As(err, &badStatusErr) && badStatusErr.Rsp.StatusCode == http.StatusNotModified {
+		log.Debugf("%v not modified upstream", d.Name)
+		if err := d.cache.Revalidated(d.Name, url, badStatusErr.Rsp.Header, time.Now()); err != nil {
+			log.Errorf("cannot record revalidation: %v", err)
+		}
+		return errEntryNotModified
+	}
+	return err
+}
+
+// setConditionalHeaders makes the request conditional on the upstream data
+// having changed since the cache entry was obtained, returns false if the
+// entry has no usable validators
+func setConditionalHeaders(req *http.Request, meta *EntryMeta) bool {
+	conditional := false
+	// entity tags are only comparable for the same location
+	if meta.ETag != "" && meta.Mirror == req.URL.String() {
+		req.Header.Set("If-None-Match", meta.ETag)
+		conditional = true
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+		conditional = true
+	}
+	return conditional
 }
 
-func doFromCache(name string, w http.ResponseWriter, r *http.Request, cache *Cache) (bool, error) {
+// doFromCache serves the cache entry, meta is the metadata of the entry if it
+// has already been obtained
+func doFromCache(name string, w http.ResponseWriter, r *http.Request, cache *Cache, meta *EntryMeta) (bool, error) {
 	cachedr, sz, err := cache.Get(name)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -268,25 +626,122 @@ func doFromCache(name string, w http.ResponseWriter, r *http.Request, cache *Cac
 	log.Debugf("getting from cache, size: %v", sz)
 	defer cachedr.Close()
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	http.ServeContent(w, r, name, time.Now(), cachedr)
+	// the entry may have been replaced since the metadata was obtained
+	if meta == nil || (meta.ContentLength != 0 && meta.ContentLength != sz) {
+		meta = getMeta(cache, name)
+	}
+	contentType := "application/octet-stream"
+	modTime := time.Now()
+	if meta != nil {
+		if meta.ContentType != "" {
+			contentType = meta.ContentType
+		}
+		if meta.ETag != "" {
+			w.Header().Set("ETag", meta.ETag)
+		}
+		modTime = meta.ModTime()
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	// takes care of conditional and range requests
+	http.ServeContent(w, r, name, modTime, cachedr)
 
 	return true, nil
 }
 
-func doFromUpstream(name string, client *http.Client, req *http.Request,
-	w http.ResponseWriter, cache *Cache) error {
+// doStaleFromCache serves a cache entry that could not be confirmed to be up to
+// date with upstream, the client is warned about it
+func doStaleFromCache(name string, w http.ResponseWriter, r *http.Request, cache *Cache, meta *EntryMeta, warning string) (bool, error) {
+	w.Header().Set("Warning", warning)
+	w.Header().Set("X-Cache", "STALE")
+	found, err := doFromCache(name, w, r, cache, meta)
+	if !found {
+		w.Header().Del("Warning")
+		w.Header().Del("X-Cache")
+	}
+	return found, err
+}
+
+// doFromUpstream executes the upstream request and writes the response data
+// to the download. If the download has already started, only the remaining
+// data is requested. Similarly, if the cache holds partial data of the entry,
+// the download is resumed, provided that the upstream data has not changed.
+// Transfers exceeding the limits are reported as interrupted.
+func doFromUpstream(d *Download, client *http.Client, req *http.Request, limits TransferLimits) error {
+	url := req.URL.String()
+
+	progress, started, err := d.Progress()
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("cannot obtain partial data of %v: %v", d.Name, err)
+	}
+	var offset int64
+	if progress != nil && progress.Size > 0 {
+		validator := progress.validatorFor(url)
+		switch {
+		case validator != "":
+			log.Debugf("resuming %v after %v bytes", d.Name, progress.Size)
+			offset = progress.Size
+			req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+			req.Header.Set("If-Range", validator)
+		case started:
+			return &errResumeMismatch{
+				Upstream: url,
+				err:      errors.New("no usable validator"),
+			}
+		}
+	}
 
-	rsp, err := client.Do(req)
+	// canceled when the transfer of the body stalls
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	rsp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return &errUpstreamFailed{err: err}
 	}
 	log.Debugf("got response: %v", rsp)
 	defer rsp.Body.Close()
 
-	if rsp.StatusCode != 200 {
-		// TODO rethink handling of various non 200 statuses such as 206
-		// partial content
+	header := rsp.Header
+	switch {
+	case rsp.StatusCode == http.StatusOK && started && offset != 0:
+		// the data that has been passed to the clients cannot be
+		// replaced
+		return &errResumeMismatch{
+			Upstream: url,
+			err:      errors.New("range request not honored"),
+		}
+	case rsp.StatusCode == http.StatusOK:
+		// either a regular request, or upstream data has changed since
+		// the partial data was obtained
+		offset = 0
+	case offset != 0 && rsp.StatusCode == http.StatusPartialContent:
+		total, err := checkResumed(rsp, url, progress, offset)
+		if err == nil && started {
+			if expected := d.ExpectedSize(); expected != -1 && expected != total {
+				err = fmt.Errorf("size mismatch, got %v expected %v", total, expected)
+			}
+		}
+		if err != nil {
+			if started {
+				return &errResumeMismatch{Upstream: url, err: err}
+			}
+			log.Errorf("cannot resume %v from %s: %v", d.Name, req.URL, err)
+			return restartFromUpstream(d, client, req, limits)
+		}
+		// the client gets all of the data
+		header = rsp.Header.Clone()
+		header.Del("Content-Range")
+		header.Set("Content-Length", strconv.FormatInt(total, 10))
+	case offset != 0 && rsp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		if started {
+			return &errResumeMismatch{
+				Upstream: url,
+				err:      errors.New("range not satisfiable"),
+			}
+		}
+		log.Errorf("cannot resume %v from %s: range not satisfiable", d.Name, req.URL)
+		return restartFromUpstream(d, client, req, limits)
+	default:
 		log.Errorf("got status %v from upstream %s",
 			rsp.StatusCode, req.URL)
 
@@ -298,36 +753,152 @@ func doFromUpstream(name string, client *http.Client, req *http.Request,
 		return &badStatusErr
 	}
 
-	out, err := cache.Put(name)
-	if err != nil {
-		return fmt.Errorf("cannot write to cache: %w", err)
+	if started {
+		log.Infof("continuing download of %v from %s", d.Name, req.URL)
+		d.Continue(url, header)
+	} else {
+		if err := d.Begin(url, header, offset); err != nil {
+			return fmt.Errorf("cannot write to cache: %w", err)
+		}
+		log.Infof("downloading %v from %s to cache", d.Name, req.URL)
+	}
+
+	body := newGuardedBody(rsp.Body, limits, cancel)
+	defer body.Stop()
+	if _, err := io.Copy(d, upstreamBody{body}); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// the body was shorter than announced
+			d.cache.lengthMismatch()
+		}
+		return fmt.Errorf("cannot download data: %w", err)
+	}
+	if err := checkLength(d, url); err != nil {
+		return err
+	}
+	log.Debugf("upstream download finished")
+	return nil
+}
+
+// checkLength verifies that the data written to the download matches the
+// length announced by upstream, if any. Data that is too short can be
+// completed from another mirror.
+func checkLength(d *Download, url string) error {
+	expected, written := d.ExpectedSize(), d.Written()
+	if expected == -1 || expected == written {
+		return nil
+	}
+	d.cache.lengthMismatch()
+	err := &errLengthMismatch{Upstream: url, Expected: expected, Got: written}
+	if written < expected {
+		return &errUpstreamInterrupted{err: err}
+	}
+	return err
+}
+
+// upstreamBody reports errors reading the upstream response body as
+// errUpstreamInterrupted, so that these can be told apart from errors writing
+// the data
+type upstreamBody struct {
+	io.Reader
+}
+
+func (u upstreamBody) Read(p []byte) (int, error) {
+	n, err := u.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = &errUpstreamInterrupted{err: err}
+	}
+	return n, err
+}
+
+// restartFromUpstream drops the partial data that cannot be resumed and
+// repeats the request for all of the data
+func restartFromUpstream(d *Download, client *http.Client, req *http.Request, limits TransferLimits) error {
+	if err := d.cache.DropPartial(d.Name); err != nil {
+		return fmt.Errorf("cannot drop partial data: %w", err)
+	}
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+	return doFromUpstream(d, client, req, limits)
+}
+
+// checkResumed verifies that the partial content response from given URL
+// carries the data following the partial data that was already obtained, and
+// returns the total size of the data
+func checkResumed(rsp *http.Response, url string, partial *PartialInfo, offset int64) (total int64, err error) {
+	var start, end int64
+	contentRange := rsp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return 0, fmt.Errorf("cannot parse content range %q: %v", contentRange, err)
+	}
+	if start != offset || end != total-1 {
+		return 0, fmt.Errorf("unexpected content range %q", contentRange)
+	}
+	// entity tags are only comparable for the same location
+	etag := rsp.Header.Get("ETag")
+	if partial.URL == url && partial.ETag != "" && etag != "" && etag != partial.ETag {
+		return 0, fmt.Errorf("entity tag mismatch, got %v expected %v", etag, partial.ETag)
 	}
-	defer out.Commit()
+	if lm := rsp.Header.Get("Last-Modified"); partial.LastModified != "" && lm != "" && lm != partial.LastModified {
+		return 0, fmt.Errorf("modification time mismatch, got %v expected %v", lm, partial.LastModified)
+	}
+	return total, nil
+}
 
-	// setup TeeReader so that the data makes to the disk while it's also
-	// sent to the original requester
-	tr := io.TeeReader(rsp.Body, out)
+// followDownload streams the data of a download to the client
+func followDownload(w http.ResponseWriter, r *http.Request, d *Download) {
+	header, rd, err := d.Follow(r.Context())
+	if err == errEntryNotModified {
+		found, err := doFromCache(d.Name, w, r, d.cache, nil)
+		if err == nil && !found {
+			err = errors.New("cache entry is gone")
+		}
+		if err != nil {
+			writeUpstreamError(w, err)
+		}
+		return
+	}
+	var failedErr *errUpstreamFailed
+	var exhaustedErr *errMirrorsExhausted
+	if errors.As(err, &failedErr) || (errors.As(err, &exhaustedErr) && exhaustedErr.unreachable()) {
+		// upstream is unreachable, the cached data is better than
+		// nothing
+		if found, _ := doStaleFromCache(d.Name, w, r, d.cache, nil, warnRevalidationFailed); found {
+			log.Infof("serving stale %v: %v", d.Name, err)
+			return
+		}
+	}
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	defer rd.Close()
 
 	// copy over headers from upstream response
-	copyHeaders(w.Header(), rsp.Header,
-		[]string{"Content-Type", "Content-Length",
-			"ETag", "Last-Modified",
-			"Date"})
+	copyHeaders(w.Header(), header, forwardedHeaders)
 	// let the client know we're good
 	w.WriteHeader(http.StatusOK)
 
-	log.Infof("downloading %v from %s to cache", name, req.URL)
-	// send over the data
-	if _, err := io.Copy(w, tr); err != nil {
-		// we've already sent a status header, we're just streaming data
-		// now, if that fails, discard any data cached so far
-		log.Errorf("copy failed: %v, discarding cache entry", err)
-		if err := out.Abort(); err != nil {
-			log.Errorf("failed to discard cache entry: %v", err)
-		}
+	log.Debugf("following download of %v", d.Name)
+	// send over the data, we've already sent a status header, if that
+	// fails the client will get a truncated response
+	if _, err := io.Copy(flushWriter{w}, rd); err != nil {
+		log.Errorf("following download of %v failed: %v", d.Name, err)
 	}
-	log.Debugf("upstream download finished")
-	return nil
+}
+
+// flushWriter sends the data to the client as soon as it has been written,
+// rather than waiting for the response buffer to fill up, the data of a
+// download may be trickling in slowly
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(data []byte) (int, error) {
+	n, err := f.w.Write(data)
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return n, err
 }
 
 func copyHeaders(to http.Header, from http.Header, which []string) {
@@ -22,14 +22,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -108,7 +116,7 @@ func TestDoFromCache(t *testing.T) {
 	rec := httptest.NewRecorder()
 	r, err := http.NewRequest(http.MethodGet, "/foo", nil)
 	assert.NoError(t, err)
-	found, err := doFromCache("foo", rec, r, &c)
+	found, err := doFromCache("foo", rec, r, &c, nil)
 	assert.NoError(t, err)
 	assert.False(t, found)
 
@@ -119,14 +127,14 @@ func TestDoFromCache(t *testing.T) {
 	cto.Commit()
 
 	// make it non readable
-	cpath := c.getCachePath("foo")
+	cpath := filepath.Join(c.Dir, "foo")
 	err = os.Chmod(cpath, 0200)
 	assert.NoError(t, err)
 
 	r, err = http.NewRequest(http.MethodGet, "/foo", nil)
 	assert.NoError(t, err)
 	rec = httptest.NewRecorder()
-	found, err = doFromCache("foo", rec, r, &c)
+	found, err = doFromCache("foo", rec, r, &c, nil)
 	assert.Error(t, err)
 	assert.False(t, found)
 
@@ -137,7 +145,7 @@ func TestDoFromCache(t *testing.T) {
 	r, err = http.NewRequest(http.MethodGet, "/foo", nil)
 	assert.NoError(t, err)
 	rec = httptest.NewRecorder()
-	found, err = doFromCache("foo", rec, r, &c)
+	found, err = doFromCache("foo", rec, r, &c, nil)
 	assert.NoError(t, err)
 	assert.True(t, found)
 
@@ -201,12 +209,11 @@ func TestDoFromUpstream4xx(t *testing.T) {
 	})
 	defer srv.Close()
 
-	rec := httptest.NewRecorder()
 	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/foo", nil)
-	err = doFromUpstream("foo", &http.Client{}, req, rec, &c)
+	d, _ := c.StartDownload("foo")
+	err = doFromUpstream(d, &http.Client{}, req, TransferLimits{})
 	require.NotNil(t, err)
 	assert.Regexp(t, `(?m)^bad upstream ".*" status 404, .*$`, err)
-	assert.False(t, rec.Flushed)
 
 }
 
@@ -225,12 +232,11 @@ func TestDoFromUpstream3xx(t *testing.T) {
 	})
 	defer srv.Close()
 
-	rec := httptest.NewRecorder()
 	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/bar", nil)
-	err = doFromUpstream("bar", &http.Client{}, req, rec, &c)
+	d, _ := c.StartDownload("bar")
+	err = doFromUpstream(d, &http.Client{}, req, TransferLimits{})
 	require.NotNil(t, err)
 	assert.Regexp(t, `(?m)^bad upstream ".*" status 304, .*$`, err)
-	assert.False(t, rec.Flushed)
 
 	// check the error
 	var badStatusErr *errUpstreamBadStatus
@@ -258,10 +264,15 @@ func TestDoFromUpstreamHappy(t *testing.T) {
 	})
 	defer srv.Close()
 
-	rec := httptest.NewRecorder()
 	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/foo", nil)
-	err = doFromUpstream("foo", &http.Client{}, req, rec, &c)
+	d, _ := c.StartDownload("foo")
+	err = doFromUpstream(d, &http.Client{}, req, TransferLimits{})
+	assert.NoError(t, err)
+	err = d.Finish(err)
 	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	followDownload(rec, req, d)
 	assert.Equal(t, http.StatusOK, rec.Code)
 	assert.Equal(t, []byte("foo"), rec.Body.Bytes())
 
@@ -272,6 +283,73 @@ func TestDoFromUpstreamHappy(t *testing.T) {
 	assert.Equal(t, []byte("foo"), data)
 }
 
+// bodyRoundTripper responds with given body and headers, regardless of what
+// the body actually holds
+type bodyRoundTripper struct {
+	header http.Header
+	body   string
+}
+
+func (rt *bodyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     rt.header,
+		Body:       ioutil.NopCloser(strings.NewReader(rt.body)),
+		Request:    req,
+	}, nil
+}
+
+func TestDoFromUpstreamLengthMismatch(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-via-from-cache-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{Dir: td}
+
+	// the connection is closed cleanly, but too early
+	client := &http.Client{Transport: &bodyRoundTripper{
+		header: http.Header{"Content-Length": []string{"11"}, "Etag": []string{`"foo"`}},
+		body:   "hello",
+	}}
+	req, _ := http.NewRequest(http.MethodGet, "http://upstream/foo", nil)
+	d, _ := c.StartDownload("foo")
+	err = doFromUpstream(d, client, req, TransferLimits{})
+	var interruptedErr *errUpstreamInterrupted
+	var mismatchErr *errLengthMismatch
+	require.True(t, errors.As(err, &interruptedErr), "unexpected error %v", err)
+	require.True(t, errors.As(err, &mismatchErr))
+	assert.Equal(t, int64(11), mismatchErr.Expected)
+	assert.Equal(t, int64(5), mismatchErr.Got)
+	assert.NoError(t, d.Finish(err))
+
+	// nothing is committed, the data can be completed later
+	_, _, err = c.Get("foo")
+	assert.True(t, os.IsNotExist(err))
+	pi, err := c.GetPartial("foo")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), pi.Size)
+
+	// more data than announced
+	client.Transport = &bodyRoundTripper{
+		header: http.Header{"Content-Length": []string{"3"}, "Etag": []string{`"bar"`}},
+		body:   "hello",
+	}
+	req, _ = http.NewRequest(http.MethodGet, "http://upstream/bar", nil)
+	d, _ = c.StartDownload("bar")
+	err = doFromUpstream(d, client, req, TransferLimits{})
+	require.True(t, errors.As(err, &mismatchErr), "unexpected error %v", err)
+	assert.False(t, errors.As(err, &interruptedErr))
+	assert.NoError(t, d.Finish(err))
+
+	// the data is discarded
+	_, _, err = c.Get("bar")
+	assert.True(t, os.IsNotExist(err))
+	_, err = c.GetPartial("bar")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, 2, c.Stats().LengthMismatch)
+}
+
 type viaFixture struct {
 	via      *ViaDownloadServer
 	cache    *Cache
@@ -409,6 +487,118 @@ func TestViaFromUpstreamBadMirror(t *testing.T) {
 	assert.True(t, os.IsNotExist(err))
 }
 
+func TestViaFromUpstreamFailover(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	srv := newMockUpstreamServer(t, map[string]mockUpstreamResponse{
+		"/foo": {Body: "this is srv"},
+	})
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{"http://bar-mirror.invalid:1234", dead.URL, srv.URL})
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "this is srv", rec.Body.String())
+	in, _, err := cache.Get("foo")
+	require.NoError(t, err)
+	defer in.Close()
+	data, _ := ioutil.ReadAll(in)
+	assert.Equal(t, []byte("this is srv"), data)
+}
+
+func TestViaFromUpstreamFailoverMisconfigured(t *testing.T) {
+	loop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+	}))
+	defer loop.Close()
+	srv := newMockUpstreamServer(t, map[string]mockUpstreamResponse{
+		"/foo": {Body: "this is srv"},
+	})
+	defer srv.Close()
+
+	misconfigured := []string{"ftp://mirror.invalid", "http://%zz", loop.URL}
+	fixture := setupVia(t, append(misconfigured, srv.URL))
+	defer fixture.Cleanup()
+	via := fixture.via
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "this is srv", rec.Body.String())
+
+	// the error of every mirror is listed when none of them works
+	via.Mirrors = misconfigured
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/bar", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	body := rec.Body.String()
+	assert.Regexp(t, `(?m)^ - ftp://mirror.invalid: upstream request failed: .*unsupported protocol scheme`, body)
+	assert.Regexp(t, `(?m)^ - http://%zz: upstream request failed: cannot prepare request`, body)
+	assert.Regexp(t, `(?m)^ - `+regexp.QuoteMeta(loop.URL)+`: upstream request failed: .*stopped after 10 redirects`, body)
+}
+
+func TestViaFromUpstreamAllFailed(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	broken := newMockUpstreamServer(t, map[string]mockUpstreamResponse{
+		"/foo": {Code: http.StatusServiceUnavailable},
+	})
+	defer broken.Close()
+	missing := newMockUpstreamServer(t, map[string]mockUpstreamResponse{
+		"/foo": {Code: http.StatusNotFound},
+	})
+	defer missing.Close()
+
+	fixture := setupVia(t, []string{dead.URL, broken.URL, missing.URL})
+	defer fixture.Cleanup()
+	via := fixture.via
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	// the error of every mirror is listed
+	body := rec.Body.String()
+	assert.Regexp(t, `(?m)^error: mirrors exhausted$`, body)
+	assert.Regexp(t, `(?m)^ - `+regexp.QuoteMeta(dead.URL)+`: upstream request failed: .*connection refused`, body)
+	assert.Regexp(t, `(?m)^ - `+regexp.QuoteMeta(broken.URL)+`: bad upstream .* status 503`, body)
+	assert.Regexp(t, `(?m)^ - `+regexp.QuoteMeta(missing.URL)+`: bad upstream .* status 404`, body)
+}
+
+func TestViaFromUpstreamTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	missing := newMockUpstreamServer(t, map[string]mockUpstreamResponse{
+		"/foo": {Code: http.StatusNotFound},
+	})
+	defer missing.Close()
+
+	fixture := setupVia(t, []string{slow.URL, missing.URL, slow.URL})
+	defer fixture.Cleanup()
+	via := fixture.via
+	via.ClientTimeout = 50 * time.Millisecond
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	assert.Contains(t, rec.Body.String(), "timeout awaiting response headers")
+}
+
 func TestViaFromUpstreamNotModified(t *testing.T) {
 	srv := newMockUpstreamServer(t, map[string]mockUpstreamResponse{
 		"/foo": {Code: http.StatusNotModified},
@@ -440,9 +630,20 @@ func TestViaStats(t *testing.T) {
 	err := json.Unmarshal([]byte(body), &stats)
 	require.NoError(t, err)
 	assert.EqualValues(t, map[string]interface{}{
-		"Hit":          float64(0),
-		"Miss":         float64(0),
-		"PurgeHistory": nil,
+		"Hit":                  float64(0),
+		"Miss":                 float64(0),
+		"HotHit":               float64(0),
+		"HotMiss":              float64(0),
+		"Corrupt":              float64(0),
+		"LengthMismatch":       float64(0),
+		"TemporaryRemoved":     float64(0),
+		"TemporaryRemovedSize": float64(0),
+		"PurgeHistory":         nil,
+		"Upstream": map[string]interface{}{
+			"Requests":    float64(0),
+			"ReusedConns": float64(0),
+			"Stalled":     float64(0),
+		},
 	}, stats)
 }
 
@@ -512,6 +713,129 @@ func TestViaDataDeleteHappy(t *testing.T) {
 	assert.True(t, os.IsNotExist(err))
 }
 
+// holdingStorage holds the reads of entry data until released
+type holdingStorage struct {
+	*MemoryStorage
+	held    chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *holdingStorage) Get(name string) (StorageReader, StorageInfo, error) {
+	if !strings.HasPrefix(name, cacheStateDir+"/") {
+		s.once.Do(func() { close(s.held) })
+		<-s.release
+	}
+	return s.MemoryStorage.Get(name)
+}
+
+func getFsckStatus(t *testing.T, via *ViaDownloadServer) FsckStatus {
+	rec := httptest.NewRecorder()
+	via.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_viadown/fsck", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var status FsckStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	return status
+}
+
+func TestViaFsck(t *testing.T) {
+	fixture := setupVia(t, nil)
+	defer fixture.Cleanup()
+	via := fixture.via
+	s := &holdingStorage{
+		MemoryStorage: &MemoryStorage{},
+		held:          make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	fixture.cache.Storage = s
+	close(s.release)
+
+	putEntry(t, fixture.cache, "foo", "foo")
+	putEntry(t, fixture.cache, "bar", "bar")
+	require.NoError(t, writeObject(s.MemoryStorage, "bar", []byte("baz")))
+	s.release = make(chan struct{})
+
+	// nothing was checked yet
+	assert.Equal(t, FsckStatus{}, getFsckStatus(t, via))
+
+	rec := httptest.NewRecorder()
+	via.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_viadown/fsck", nil))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	var status FsckStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.True(t, status.Running)
+	assert.Nil(t, status.Report)
+
+	// only one check runs at a time
+	<-s.held
+	rec = httptest.NewRecorder()
+	via.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_viadown/fsck", nil))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.True(t, getFsckStatus(t, via).Running)
+
+	close(s.release)
+	for start := time.Now(); getFsckStatus(t, via).Running; time.Sleep(10 * time.Millisecond) {
+		require.True(t, time.Since(start) < 5*time.Second, "check did not finish")
+	}
+	status = getFsckStatus(t, via)
+	assert.False(t, status.Finished.Before(status.Started))
+	assert.Empty(t, status.Error)
+	require.NotNil(t, status.Report)
+	assert.Equal(t, 2, status.Report.Checked)
+	require.Len(t, status.Report.Corrupt, 1)
+	assert.Equal(t, "bar", status.Report.Corrupt[0].Name)
+
+	_, _, err := fixture.cache.Get("bar")
+	assert.True(t, os.IsNotExist(err))
+
+	// another check can be started once the last one is finished
+	rec = httptest.NewRecorder()
+	via.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_viadown/fsck", nil))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	for start := time.Now(); getFsckStatus(t, via).Running; time.Sleep(10 * time.Millisecond) {
+		require.True(t, time.Since(start) < 5*time.Second, "check did not finish")
+	}
+	assert.Equal(t, 1, getFsckStatus(t, via).Report.Checked)
+}
+
+func TestViaFsckStop(t *testing.T) {
+	fixture := setupVia(t, nil)
+	defer fixture.Cleanup()
+	via := fixture.via
+	s := &holdingStorage{
+		MemoryStorage: &MemoryStorage{},
+		held:          make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	fixture.cache.Storage = s
+	close(s.release)
+
+	putEntry(t, fixture.cache, "foo", "foo")
+	putEntry(t, fixture.cache, "bar", "bar")
+	s.release = make(chan struct{})
+
+	// nothing to stop
+	require.NoError(t, via.StopFsck(context.Background()))
+
+	rec := httptest.NewRecorder()
+	via.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_viadown/fsck", nil))
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	<-s.held
+
+	// the check does not finish in time
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, via.StopFsck(ctx))
+
+	// but is interrupted once the entry being checked is done with
+	close(s.release)
+	require.NoError(t, via.StopFsck(context.Background()))
+	status := getFsckStatus(t, via)
+	assert.False(t, status.Running)
+	assert.Equal(t, context.Canceled.Error(), status.Error)
+	assert.Nil(t, status.Report)
+}
+
 func TestViaDataDeleteErrors(t *testing.T) {
 	fixture := setupVia(t, nil)
 	defer fixture.Cleanup()
@@ -543,3 +867,910 @@ func TestViaDataDeleteErrors(t *testing.T) {
 		"Error": "older-than-days is not an integer",
 	}, errRsp)
 }
+
+func TestViaFromUpstreamCoalesced(t *testing.T) {
+	var requests int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Length", "10")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+		w.Write([]byte("world"))
+	}))
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+
+	get := func(rec *httptest.ResponseRecorder, done chan struct{}) {
+		req, err := http.NewRequest(http.MethodGet, "/foo", nil)
+		require.NoError(t, err)
+		via.ServeHTTP(rec, req)
+		close(done)
+	}
+
+	rec1, done1 := httptest.NewRecorder(), make(chan struct{})
+	go get(rec1, done1)
+	<-started
+
+	rec2, done2 := httptest.NewRecorder(), make(chan struct{})
+	go get(rec2, done2)
+
+	// wait for the second request to follow the download
+	d, isNew := cache.StartDownload("/foo")
+	require.False(t, isNew)
+	for {
+		d.lock.Lock()
+		readers := d.readers
+		d.lock.Unlock()
+		if readers == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	<-done1
+	<-done2
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	for _, rec := range []*httptest.ResponseRecorder{rec1, rec2} {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "helloworld", rec.Body.String())
+		assert.Equal(t, "10", rec.Header().Get("Content-Length"))
+	}
+
+	in, _, err := cache.Get("foo")
+	require.NoError(t, err)
+	defer in.Close()
+	data, _ := ioutil.ReadAll(in)
+	assert.Equal(t, []byte("helloworld"), data)
+}
+
+func TestViaFromUpstreamCoalescedFailed(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+	via := fixture.via
+
+	rec1, done1 := httptest.NewRecorder(), make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "/foo", nil)
+		via.ServeHTTP(rec1, req)
+		close(done1)
+	}()
+	<-started
+
+	d, isNew := fixture.cache.StartDownload("/foo")
+	require.False(t, isNew)
+	followDone := make(chan struct{})
+	rec2 := httptest.NewRecorder()
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "/foo", nil)
+		followDownload(rec2, req, d)
+		close(followDone)
+	}()
+
+	close(release)
+	<-done1
+	<-followDone
+
+	for _, rec := range []*httptest.ResponseRecorder{rec1, rec2} {
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Regexp(t, `(?m)^error: mirrors exhausted.*`, rec.Body.String())
+	}
+}
+
+func TestViaFromUpstreamClientGone(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+		w.Write([]byte("world"))
+	}))
+	defer upstream.Close()
+
+	fixture := setupVia(t, []string{upstream.URL})
+	defer fixture.Cleanup()
+	srv := httptest.NewServer(fixture.via)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/foo", nil)
+	require.NoError(t, err)
+	rsp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	<-started
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(rsp.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	// client goes away
+	cancel()
+	rsp.Body.Close()
+
+	d, isNew := fixture.cache.StartDownload("/foo")
+	require.False(t, isNew)
+	// wait for the download to become orphaned
+	for {
+		d.lock.Lock()
+		readers := d.readers
+		d.lock.Unlock()
+		if readers == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	// the data makes it to the cache
+	<-d.Context().Done()
+	in, _, err := fixture.cache.Get("foo")
+	require.NoError(t, err)
+	defer in.Close()
+	data, _ := ioutil.ReadAll(in)
+	assert.Equal(t, []byte("helloworld"), data)
+}
+
+func TestViaFromUpstreamResume(t *testing.T) {
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	content := "hello world"
+	var ranges []string
+	interrupt := true
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"1234"`)
+		if interrupt {
+			interrupt = false
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(content[:6]))
+			w.(http.Flusher).Flush()
+			<-release
+			// drop the connection
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "foo", modTime, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+
+	// truncated response
+	assert.Equal(t, "hello ", getTruncated(t, via, "/foo", 6, release))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+
+	_, _, err = cache.Get("foo")
+	assert.True(t, os.IsNotExist(err))
+	pi, err := cache.GetPartial("/foo")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), pi.Size)
+
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.String())
+	assert.Equal(t, strconv.Itoa(len(content)), rec.Header().Get("Content-Length"))
+	assert.Equal(t, []string{"", "bytes=6-"}, ranges)
+
+	in, _, err := cache.Get("foo")
+	require.NoError(t, err)
+	defer in.Close()
+	data, _ := ioutil.ReadAll(in)
+	assert.Equal(t, []byte(content), data)
+
+	_, err = cache.GetPartial("/foo")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestViaFromUpstreamResumeChanged(t *testing.T) {
+	fixture := setupVia(t, nil)
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+
+	content := "hello world"
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		// data has changed since, the range request will not be honored
+		w.Header().Set("ETag", `"5678"`)
+		http.ServeContent(w, r, "foo", time.Time{}, strings.NewReader(content))
+	}))
+	defer srv.Close()
+	via.Mirrors = []string{srv.URL}
+
+	// partial data obtained from the same mirror
+	ct, err := cache.PutPartial("/foo", PartialInfo{URL: srv.URL + "/foo", ETag: `"1234"`}, 0)
+	require.NoError(t, err)
+	ct.Write([]byte("garbage"))
+	require.NoError(t, ct.Suspend())
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.String())
+	assert.Equal(t, []string{"bytes=7-"}, ranges)
+
+	in, _, err := cache.Get("foo")
+	require.NoError(t, err)
+	defer in.Close()
+	data, _ := ioutil.ReadAll(in)
+	assert.Equal(t, []byte(content), data)
+}
+
+func TestViaFromUpstreamResumeNotSatisfiable(t *testing.T) {
+	fixture := setupVia(t, nil)
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+
+	content := "hello"
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"1234"`)
+		http.ServeContent(w, r, "foo", time.Time{}, strings.NewReader(content))
+	}))
+	defer srv.Close()
+	via.Mirrors = []string{srv.URL}
+
+	// more partial data than there is upstream
+	ct, err := cache.PutPartial("/foo", PartialInfo{URL: srv.URL + "/foo", ETag: `"1234"`}, 0)
+	require.NoError(t, err)
+	ct.Write([]byte("hello world"))
+	require.NoError(t, ct.Suspend())
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.String())
+	assert.Equal(t, []string{"bytes=11-", ""}, ranges)
+}
+
+// getTruncated obtains the data of a download that is expected to break after
+// given number of bytes, the upstream is released once the client has received
+// them
+func getTruncated(t *testing.T, via *ViaDownloadServer, name string, after int, release chan struct{}) string {
+	srv := httptest.NewServer(via)
+	defer srv.Close()
+
+	rsp, err := http.Get(srv.URL + name)
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	data := make([]byte, after)
+	_, err = io.ReadFull(rsp.Body, data)
+	require.NoError(t, err)
+	close(release)
+
+	rest, _ := ioutil.ReadAll(rsp.Body)
+	return string(data) + string(rest)
+}
+
+// newBrokenUpstreamServer returns a server dropping the connection after
+// sending given number of bytes, when release is not nil, the connection is
+// dropped only once it is closed
+func newBrokenUpstreamServer(t *testing.T, content string, modTime time.Time, after int, release chan struct{}) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Range"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+		w.Header().Set("ETag", `"broken"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(content[:after]))
+		w.(http.Flusher).Flush()
+		if release != nil {
+			<-release
+		}
+		// drop the connection
+		panic(http.ErrAbortHandler)
+	}))
+	require.NotNil(t, srv)
+	return srv
+}
+
+func TestViaFromUpstreamFailoverMidStream(t *testing.T) {
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	content := "hello world"
+
+	srv1 := newBrokenUpstreamServer(t, content, modTime, 6, nil)
+	defer srv1.Close()
+
+	var ifRange []string
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "bytes=6-", r.Header.Get("Range"))
+		ifRange = append(ifRange, r.Header.Get("If-Range"))
+		w.Header().Set("ETag", `"other"`)
+		http.ServeContent(w, r, "foo", modTime, strings.NewReader(content))
+	}))
+	defer srv2.Close()
+
+	fixture := setupVia(t, []string{srv1.URL, srv2.URL})
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.String())
+	// the entity tag is specific to the mirror, modification time is used
+	// instead
+	assert.Equal(t, []string{modTime.Format(http.TimeFormat)}, ifRange)
+	// the first mirror sent less data than announced
+	assert.Equal(t, 1, cache.Stats().LengthMismatch)
+
+	in, _, err := cache.Get("foo")
+	require.NoError(t, err)
+	defer in.Close()
+	data, _ := ioutil.ReadAll(in)
+	assert.Equal(t, []byte(content), data)
+}
+
+func TestViaFromUpstreamFailoverMidStreamMismatch(t *testing.T) {
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	content := "hello world"
+
+	release := make(chan struct{})
+	srv1 := newBrokenUpstreamServer(t, content, modTime, 6, release)
+	defer srv1.Close()
+
+	// different data on the other mirror
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "bytes=6-", r.Header.Get("Range"))
+		http.ServeContent(w, r, "foo", modTime.Add(time.Hour), strings.NewReader("HELLO WORLD"))
+	}))
+	defer srv2.Close()
+
+	// same data, but different size
+	srv3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "bytes=6-", r.Header.Get("Range"))
+		http.ServeContent(w, r, "foo", modTime, strings.NewReader(content+"!"))
+	}))
+	defer srv3.Close()
+
+	fixture := setupVia(t, []string{srv1.URL, srv2.URL, srv3.URL})
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+
+	// truncated
+	assert.Equal(t, content[:6], getTruncated(t, via, "/foo", 6, release))
+
+	_, _, err := cache.Get("foo")
+	assert.True(t, os.IsNotExist(err))
+	// data obtained so far is kept
+	pi, err := cache.GetPartial("/foo")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), pi.Size)
+}
+
+func TestDoFromCacheMeta(t *testing.T) {
+	td, err := ioutil.TempDir("", "viadown-via-from-cache-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	c := Cache{
+		Dir: td,
+	}
+
+	cto, err := c.Put("foo")
+	require.NoError(t, err)
+	cto.Meta = EntryMeta{
+		ContentType:  "application/foo",
+		ETag:         `"1234"`,
+		LastModified: "Wed, 21 Oct 2015 07:28:00 GMT",
+	}
+	cto.Write([]byte("foo"))
+	require.NoError(t, cto.Commit())
+
+	r, err := http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	found, err := doFromCache("foo", rec, r, &c, nil)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "foo", rec.Body.String())
+	assert.Equal(t, "application/foo", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `"1234"`, rec.Header().Get("ETag"))
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", rec.Header().Get("Last-Modified"))
+
+	for _, tc := range []struct {
+		header, value string
+		code          int
+	}{
+		{"If-None-Match", `"1234"`, http.StatusNotModified},
+		{"If-None-Match", `"5678"`, http.StatusOK},
+		{"If-Modified-Since", "Wed, 21 Oct 2015 07:28:00 GMT", http.StatusNotModified},
+		{"If-Modified-Since", "Thu, 22 Oct 2015 07:28:00 GMT", http.StatusNotModified},
+		{"If-Modified-Since", "Tue, 20 Oct 2015 07:28:00 GMT", http.StatusOK},
+	} {
+		r, err := http.NewRequest(http.MethodGet, "/foo", nil)
+		require.NoError(t, err)
+		r.Header.Set(tc.header, tc.value)
+		rec := httptest.NewRecorder()
+		found, err := doFromCache("foo", rec, r, &c, nil)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, tc.code, rec.Code, "%v: %v", tc.header, tc.value)
+	}
+}
+
+// countingStorage counts the reads of metadata
+type countingStorage struct {
+	*MemoryStorage
+	metaReads int32
+}
+
+func (s *countingStorage) Get(name string) (StorageReader, StorageInfo, error) {
+	if strings.HasSuffix(name, metaSuffix) {
+		atomic.AddInt32(&s.metaReads, 1)
+	}
+	return s.MemoryStorage.Get(name)
+}
+
+func TestViaFromCacheMetaReads(t *testing.T) {
+	fixture := setupVia(t, nil)
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+	s := &countingStorage{MemoryStorage: &MemoryStorage{}}
+	cache.Storage = s
+	via.Freshness = FreshnessPolicy{{Pattern: "*.db", MaxAge: time.Hour}}
+
+	for _, name := range []string{"foo.pkg", "core.db"} {
+		cto, err := cache.Put(name)
+		require.NoError(t, err)
+		cto.Meta = EntryMeta{ContentType: "application/foo"}
+		cto.Write([]byte(name))
+		require.NoError(t, cto.Commit())
+	}
+
+	for _, name := range []string{"foo.pkg", "core.db"} {
+		atomic.StoreInt32(&s.metaReads, 0)
+		rec := httptest.NewRecorder()
+		via.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, name, rec.Body.String())
+		assert.Equal(t, "application/foo", rec.Header().Get("Content-Type"))
+		// the metadata is obtained once
+		assert.Equal(t, int32(1), atomic.LoadInt32(&s.metaReads), name)
+	}
+
+	// the metadata obtained earlier no longer matches the data
+	meta, err := cache.GetMeta("core.db")
+	require.NoError(t, err)
+	putEntry(t, cache, "core.db", "replaced")
+	rec := httptest.NewRecorder()
+	found, err := doFromCache("core.db", rec, httptest.NewRequest(http.MethodGet, "/core.db", nil), cache, meta)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "replaced", rec.Body.String())
+	assert.Equal(t, "application/octet-stream", rec.Header().Get("Content-Type"))
+}
+
+func TestViaFromUpstreamMeta(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/foo")
+		w.Header().Set("ETag", `"1234"`)
+		w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		w.Write([]byte("this is upstream"))
+	}))
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+
+	assert.HTTPBodyContains(t, via.ServeHTTP, http.MethodGet, "/foo", nil, "this is upstream")
+
+	meta, err := cache.GetMeta("foo")
+	require.NoError(t, err)
+	assert.Equal(t, "application/foo", meta.ContentType)
+	assert.Equal(t, `"1234"`, meta.ETag)
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", meta.LastModified)
+	assert.Equal(t, srv.URL+"/foo", meta.Mirror)
+	assert.Equal(t, int64(len("this is upstream")), meta.ContentLength)
+
+	// now from cache
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/foo", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `"1234"`, rec.Header().Get("ETag"))
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", rec.Header().Get("Last-Modified"))
+	assert.Equal(t, CacheStats{Hit: 1, Miss: 1}, cache.Stats())
+}
+
+func TestViaRevalidateNotModified(t *testing.T) {
+	var requests int
+	var ifNoneMatch, ifModifiedSince string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		ifModifiedSince = r.Header.Get("If-Modified-Since")
+		w.Header().Set("ETag", `"5678"`)
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+	via.Freshness = FreshnessPolicy{{Pattern: "*.db", MaxAge: time.Hour}}
+
+	cto, err := cache.Put("core.db")
+	require.NoError(t, err)
+	cto.Meta = EntryMeta{
+		ETag:         `"1234"`,
+		LastModified: "Wed, 21 Oct 2015 07:28:00 GMT",
+		Mirror:       srv.URL + "/core.db",
+	}
+	cto.Write([]byte("cached"))
+	require.NoError(t, cto.Commit())
+
+	// fresh, upstream is not consulted
+	assert.HTTPBodyContains(t, via.ServeHTTP, http.MethodGet, "/core.db", nil, "cached")
+	assert.Equal(t, 0, requests)
+
+	// make the entry stale
+	meta, err := cache.GetMeta("core.db")
+	require.NoError(t, err)
+	meta.Fetched = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, writeMeta(cache.storage(), cache.getMetaName("core.db"), meta))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/core.db", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "cached", rec.Body.String())
+	assert.Equal(t, `"5678"`, rec.Header().Get("ETag"))
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, `"1234"`, ifNoneMatch)
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", ifModifiedSince)
+
+	// the entry is fresh again
+	meta, err = cache.GetMeta("core.db")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), meta.Fetched, time.Minute)
+	assert.Equal(t, `"5678"`, meta.ETag)
+	assert.HTTPBodyContains(t, via.ServeHTTP, http.MethodGet, "/core.db", nil, "cached")
+	assert.Equal(t, 1, requests)
+}
+
+func TestViaRevalidateChanged(t *testing.T) {
+	var ifModifiedSince string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifModifiedSince = r.Header.Get("If-Modified-Since")
+		w.Header().Set("Last-Modified", "Thu, 22 Oct 2015 07:28:00 GMT")
+		w.Write([]byte("updated"))
+	}))
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+	via.Freshness = FreshnessPolicy{{Pattern: "*.db", MaxAge: time.Nanosecond}}
+
+	cto, err := cache.Put("core.db")
+	require.NoError(t, err)
+	cto.Meta = EntryMeta{
+		// obtained from another mirror
+		ETag:         `"1234"`,
+		Mirror:       "http://other-mirror/core.db",
+		LastModified: "Wed, 21 Oct 2015 07:28:00 GMT",
+	}
+	cto.Write([]byte("cached"))
+	require.NoError(t, cto.Commit())
+	time.Sleep(time.Millisecond)
+
+	assert.HTTPBodyContains(t, via.ServeHTTP, http.MethodGet, "/core.db", nil, "updated")
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", ifModifiedSince)
+
+	data, err := ioutil.ReadFile(filepath.Join(fixture.cacheDir, "core.db"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("updated"), data)
+	meta, err := cache.GetMeta("core.db")
+	require.NoError(t, err)
+	assert.Equal(t, "Thu, 22 Oct 2015 07:28:00 GMT", meta.LastModified)
+	assert.Equal(t, srv.URL+"/core.db", meta.Mirror)
+}
+
+func TestViaRevalidateImmutable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected upstream request")
+	}))
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+	via := fixture.via
+	via.Freshness = FreshnessPolicy{{Pattern: "*.pkg.tar.*", Immutable: true}}
+
+	makeFile(t, filepath.Join(fixture.cacheDir, "foo.pkg.tar.zst"), []byte("cached"))
+
+	// the client asking for revalidation is answered from cache
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/foo.pkg.tar.zst", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-Modified-Since", "Wed, 21 Oct 2015 07:28:00 GMT")
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "cached", rec.Body.String())
+}
+
+func TestViaStaleUpstreamUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// nothing listens at the mirror address
+	srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+	via.Freshness = FreshnessPolicy{{Pattern: "*.db", MaxAge: time.Nanosecond}}
+
+	cto, err := cache.Put("core.db")
+	require.NoError(t, err)
+	cto.Meta = EntryMeta{LastModified: "Wed, 21 Oct 2015 07:28:00 GMT"}
+	cto.Write([]byte("cached"))
+	require.NoError(t, cto.Commit())
+	time.Sleep(time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/core.db", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "cached", rec.Body.String())
+	assert.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+	assert.Equal(t, `111 - "Revalidation Failed"`, rec.Header().Get("Warning"))
+
+	// same when the client asks for revalidation
+	makeFile(t, filepath.Join(fixture.cacheDir, "foo"), []byte("foo"))
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-Modified-Since", "Wed, 21 Oct 2015 07:28:00 GMT")
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "foo", rec.Body.String())
+	assert.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+
+	// not in cache at all
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/bar", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Contains(t, rec.Body.String(), " - "+srv.URL+": upstream request failed: ")
+	assert.Empty(t, rec.Header().Get("X-Cache"))
+	assert.Empty(t, rec.Header().Get("Warning"))
+}
+
+func TestMirrorsExhaustedUnreachable(t *testing.T) {
+	failed := &errUpstreamFailed{err: errors.New("connection refused")}
+	stalled := &errUpstreamInterrupted{err: &errTransferStalled{problem: "no data"}}
+	status := func(code int) error {
+		return &errUpstreamBadStatus{Rsp: &http.Response{StatusCode: code}}
+	}
+	for _, tc := range []struct {
+		errs        []error
+		unreachable bool
+	}{
+		{nil, false},
+		{[]error{failed}, true},
+		{[]error{failed, stalled, status(http.StatusServiceUnavailable)}, true},
+		{[]error{failed, status(http.StatusNotFound)}, false},
+		{[]error{status(http.StatusNotFound), stalled}, false},
+		{[]error{failed, &errUpstreamInterrupted{err: io.ErrUnexpectedEOF}}, false},
+	} {
+		e := &errMirrorsExhausted{}
+		for _, err := range tc.errs {
+			e.errs = append(e.errs, mirrorError{Mirror: "http://mirror", err: err})
+		}
+		assert.Equal(t, tc.unreachable, e.unreachable(), "errors %v", tc.errs)
+	}
+}
+
+func TestViaStaleMixedErrors(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	broken := newMockUpstreamServer(t, map[string]mockUpstreamResponse{
+		"/core.db":  {Code: http.StatusServiceUnavailable},
+		"/other.db": {Code: http.StatusServiceUnavailable},
+	})
+	defer broken.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+
+	fixture := setupVia(t, []string{dead.URL, broken.URL, slow.URL})
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+	via.ClientTimeout = 50 * time.Millisecond
+	via.Freshness = FreshnessPolicy{{Pattern: "*.db", MaxAge: time.Nanosecond}}
+
+	for _, name := range []string{"core.db", "other.db"} {
+		cto, err := cache.Put(name)
+		require.NoError(t, err)
+		cto.Meta = EntryMeta{LastModified: "Wed, 21 Oct 2015 07:28:00 GMT"}
+		cto.Write([]byte("cached " + name))
+		require.NoError(t, cto.Commit())
+	}
+	time.Sleep(time.Millisecond)
+
+	// none of the mirrors can be reached
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/core.db", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "cached core.db", rec.Body.String())
+	assert.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+
+	// one of the mirrors responded that the entry is gone
+	missing := newMockUpstreamServer(t, map[string]mockUpstreamResponse{
+		"/other.db": {Code: http.StatusNotFound},
+	})
+	defer missing.Close()
+	via.Mirrors = append(via.Mirrors, missing.URL)
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/other.db", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Empty(t, rec.Header().Get("X-Cache"))
+}
+
+func TestViaOffline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected upstream request")
+	}))
+	defer srv.Close()
+
+	fixture := setupVia(t, []string{srv.URL})
+	defer fixture.Cleanup()
+	cache, via := fixture.cache, fixture.via
+	via.Freshness = FreshnessPolicy{{Pattern: "*.db", MaxAge: time.Hour}}
+	via.SetOffline(true)
+
+	cto, err := cache.Put("core.db")
+	require.NoError(t, err)
+	cto.Write([]byte("cached"))
+	require.NoError(t, cto.Commit())
+	makeFile(t, filepath.Join(fixture.cacheDir, "stale.db"), []byte("stale"))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/core.db", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "cached", rec.Body.String())
+	assert.Empty(t, rec.Header().Get("X-Cache"))
+
+	// nothing is known about the entry, it would have been checked with
+	// upstream
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/stale.db", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "stale", rec.Body.String())
+	assert.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+	assert.Equal(t, `112 - "Disconnected Operation"`, rec.Header().Get("Warning"))
+
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/foo", nil)
+	require.NoError(t, err)
+	via.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	assert.Equal(t, "error: offline mode, /foo not in cache\n", rec.Body.String())
+}
+
+func TestViaOfflineToggle(t *testing.T) {
+	fixture := setupVia(t, nil)
+	defer fixture.Cleanup()
+	via := fixture.via
+
+	body := assert.HTTPBody(via.ServeHTTP, http.MethodGet, "/_viadown/offline", nil)
+	assert.JSONEq(t, `{"Offline": false}`, body)
+
+	rec := httptest.NewRecorder()
+	via.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/_viadown/offline?enabled=true", nil))
+	body = rec.Body.String()
+	assert.JSONEq(t, `{"Offline": true}`, body)
+	assert.True(t, via.IsOffline())
+
+	body = assert.HTTPBody(via.ServeHTTP, http.MethodGet, "/_viadown/offline", nil)
+	assert.JSONEq(t, `{"Offline": true}`, body)
+
+	rec = httptest.NewRecorder()
+	via.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/_viadown/offline?enabled=false", nil))
+	body = rec.Body.String()
+	assert.JSONEq(t, `{"Offline": false}`, body)
+	assert.False(t, via.IsOffline())
+
+	for _, tc := range []struct {
+		query, err string
+	}{
+		{"", "enabled not provided"},
+		{"?enabled=maybe", "enabled is not a boolean"},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/_viadown/offline"+tc.query, nil)
+		via.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, fmt.Sprintf(`{"Error": %q}`, tc.err), rec.Body.String())
+	}
+}
+
+func TestViaDataDeleteNotAccessed(t *testing.T) {
+	fixture := setupVia(t, nil)
+	defer fixture.Cleanup()
+	via := fixture.via
+
+	longAgo := time.Now().Add(-10 * 24 * time.Hour)
+	for _, name := range []string{"foo", "bar"} {
+		fpath := filepath.Join(fixture.cacheDir, name)
+		makeFile(t, fpath, []byte(name))
+		require.NoError(t, os.Chtimes(fpath, longAgo, longAgo))
+	}
+	assert.HTTPBodyContains(t, via.ServeHTTP, http.MethodGet, "/foo", nil, "foo")
+
+	body := assert.HTTPBody(via.ServeHTTP, http.MethodDelete, "/_viadown/data",
+		url.Values{
+			"older-than-days":       []string{"0"},
+			"not-accessed-for-days": []string{"5"},
+			"min-hits":              []string{"1"},
+		})
+	assert.JSONEq(t, `{"Removed": 1}`, body)
+	assert.FileExists(t, filepath.Join(fixture.cacheDir, "foo"))
+	notExist(t, filepath.Join(fixture.cacheDir, "bar"))
+
+	for _, tc := range []struct {
+		query, err string
+	}{
+		{"older-than-days=0&not-accessed-for-days=abc", "not-accessed-for-days is not an integer"},
+		{"older-than-days=0&min-hits=-1", "min-hits is not an integer"},
+	} {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, "/_viadown/data?"+tc.query, nil)
+		require.NoError(t, err)
+		via.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, fmt.Sprintf(`{"Error": %q}`, tc.err), rec.Body.String())
+	}
+}